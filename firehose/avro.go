@@ -0,0 +1,203 @@
+// Copyright 2019 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//	http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package firehose
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+)
+
+// Avro union branch indices for the implicit schema every record is
+// encoded against:
+//
+//	union { null, boolean, long, double, bytes, string, array<Value>, map<string, Value> }
+//
+// Real Avro deserialization needs the reader to already know this schema
+// (there is no schema registry lookup here), but within that schema a
+// record's shape can vary freely from one record to the next.
+const (
+	avroUnionNull = iota
+	avroUnionBoolean
+	avroUnionLong
+	avroUnionDouble
+	avroUnionBytes
+	avroUnionString
+	avroUnionArray
+	avroUnionMap
+)
+
+// avroEncoder encodes a record as Avro (https://avro.apache.org/) binary
+// data, without a schema registry: every value is written as a union of
+// Avro's scalar and container types, with the branch index doubling as a
+// type tag so a reader holding the fixed schema above can decode any
+// record shape. Hand-written for the same reason as the msgpack and cbor
+// encoders: a single, fairly small format with no need for a new
+// third-party dependency.
+type avroEncoder struct{}
+
+func (avroEncoder) Encode(record map[interface{}]interface{}) ([]byte, error) {
+	return appendAvroMap(nil, record)
+}
+
+// appendAvroUnion writes a union branch index followed by the value
+// encoded as that branch's type
+func appendAvroUnion(buf []byte, v interface{}) ([]byte, error) {
+	switch t := v.(type) {
+	case nil:
+		return appendAvroLong(buf, avroUnionNull), nil
+	case bool:
+		buf = appendAvroLong(buf, avroUnionBoolean)
+		return appendAvroBool(buf, t), nil
+	case string:
+		buf = appendAvroLong(buf, avroUnionString)
+		return appendAvroString(buf, t), nil
+	case []byte:
+		buf = appendAvroLong(buf, avroUnionBytes)
+		return appendAvroBytes(buf, t), nil
+	case int:
+		buf = appendAvroLong(buf, avroUnionLong)
+		return appendAvroLong(buf, int64(t)), nil
+	case int8:
+		buf = appendAvroLong(buf, avroUnionLong)
+		return appendAvroLong(buf, int64(t)), nil
+	case int16:
+		buf = appendAvroLong(buf, avroUnionLong)
+		return appendAvroLong(buf, int64(t)), nil
+	case int32:
+		buf = appendAvroLong(buf, avroUnionLong)
+		return appendAvroLong(buf, int64(t)), nil
+	case int64:
+		buf = appendAvroLong(buf, avroUnionLong)
+		return appendAvroLong(buf, t), nil
+	case uint:
+		buf = appendAvroLong(buf, avroUnionLong)
+		return appendAvroLong(buf, int64(t)), nil
+	case uint8:
+		buf = appendAvroLong(buf, avroUnionLong)
+		return appendAvroLong(buf, int64(t)), nil
+	case uint16:
+		buf = appendAvroLong(buf, avroUnionLong)
+		return appendAvroLong(buf, int64(t)), nil
+	case uint32:
+		buf = appendAvroLong(buf, avroUnionLong)
+		return appendAvroLong(buf, int64(t)), nil
+	case uint64:
+		buf = appendAvroLong(buf, avroUnionLong)
+		return appendAvroLong(buf, int64(t)), nil
+	case float32:
+		buf = appendAvroLong(buf, avroUnionDouble)
+		return appendAvroDouble(buf, float64(t)), nil
+	case float64:
+		buf = appendAvroLong(buf, avroUnionDouble)
+		return appendAvroDouble(buf, t), nil
+	case []interface{}:
+		buf = appendAvroLong(buf, avroUnionArray)
+		return appendAvroArray(buf, t)
+	case map[interface{}]interface{}:
+		buf = appendAvroLong(buf, avroUnionMap)
+		return appendAvroMap(buf, t)
+	case map[string]interface{}:
+		generic := make(map[interface{}]interface{}, len(t))
+		for k, v := range t {
+			generic[k] = v
+		}
+		buf = appendAvroLong(buf, avroUnionMap)
+		return appendAvroMap(buf, generic)
+	default:
+		return nil, fmt.Errorf("avro: unsupported value type %T", v)
+	}
+}
+
+// appendAvroLong zigzag-encodes v and writes it as a variable-length
+// integer, Avro's representation for both int and long
+func appendAvroLong(buf []byte, v int64) []byte {
+	u := uint64(v<<1) ^ uint64(v>>63)
+	for u >= 0x80 {
+		buf = append(buf, byte(u)|0x80)
+		u >>= 7
+	}
+	return append(buf, byte(u))
+}
+
+func appendAvroBool(buf []byte, v bool) []byte {
+	if v {
+		return append(buf, 1)
+	}
+	return append(buf, 0)
+}
+
+func appendAvroDouble(buf []byte, v float64) []byte {
+	b := make([]byte, 8)
+	binary.LittleEndian.PutUint64(b, math.Float64bits(v))
+	return append(buf, b...)
+}
+
+func appendAvroBytes(buf []byte, data []byte) []byte {
+	buf = appendAvroLong(buf, int64(len(data)))
+	return append(buf, data...)
+}
+
+func appendAvroString(buf []byte, s string) []byte {
+	buf = appendAvroLong(buf, int64(len(s)))
+	return append(buf, s...)
+}
+
+// appendAvroArray writes items as a single block followed by the
+// zero-length block that terminates an Avro array
+func appendAvroArray(buf []byte, items []interface{}) ([]byte, error) {
+	if len(items) > 0 {
+		buf = appendAvroLong(buf, int64(len(items)))
+		var err error
+		for _, item := range items {
+			buf, err = appendAvroUnion(buf, item)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	return appendAvroLong(buf, 0), nil
+}
+
+// appendAvroMap writes m as a single block of string-keyed entries
+// followed by the zero-length block that terminates an Avro map
+func appendAvroMap(buf []byte, m map[interface{}]interface{}) ([]byte, error) {
+	if len(m) > 0 {
+		buf = appendAvroLong(buf, int64(len(m)))
+		for k, v := range m {
+			key, err := avroMapKey(k)
+			if err != nil {
+				return nil, err
+			}
+			buf = appendAvroString(buf, key)
+			buf, err = appendAvroUnion(buf, v)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	return appendAvroLong(buf, 0), nil
+}
+
+// avroMapKey converts a record key to the string Avro map keys require
+func avroMapKey(k interface{}) (string, error) {
+	switch t := k.(type) {
+	case string:
+		return t, nil
+	case []byte:
+		return string(t), nil
+	default:
+		return "", fmt.Errorf("avro: unsupported map key type %T; avro map keys must be strings", k)
+	}
+}
@@ -0,0 +1,78 @@
+// Copyright 2019 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//	http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package firehose
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAvroLongZigzagEncoding(t *testing.T) {
+	assert.Equal(t, []byte{0}, appendAvroLong(nil, 0))
+	assert.Equal(t, []byte{2}, appendAvroLong(nil, 1))
+	assert.Equal(t, []byte{1}, appendAvroLong(nil, -1))
+	assert.Equal(t, []byte{3}, appendAvroLong(nil, -2))
+}
+
+func TestAvroEncoderString(t *testing.T) {
+	buf, err := appendAvroUnion(nil, "hi")
+	require.NoError(t, err)
+	want := appendAvroLong(nil, avroUnionString)
+	want = append(want, appendAvroString(nil, "hi")...)
+	assert.Equal(t, want, buf)
+}
+
+func TestAvroEncoderEmptyMap(t *testing.T) {
+	data, err := avroEncoder{}.Encode(map[interface{}]interface{}{})
+	require.NoError(t, err)
+	assert.Equal(t, []byte{0}, data, "empty map should encode as the zero-length terminal block")
+}
+
+func TestAvroEncoderRecord(t *testing.T) {
+	data, err := avroEncoder{}.Encode(map[interface{}]interface{}{"a": int64(1)})
+	require.NoError(t, err)
+
+	// map block count 1, key "a", union{long}, value 1, terminal block 0
+	want := appendAvroLong(nil, 1)
+	want = append(want, appendAvroString(nil, "a")...)
+	want = append(want, appendAvroLong(nil, avroUnionLong)...)
+	want = append(want, appendAvroLong(nil, 1)...)
+	want = append(want, appendAvroLong(nil, 0)...)
+	assert.Equal(t, want, data)
+}
+
+func TestAvroEncoderArray(t *testing.T) {
+	data, err := appendAvroArray(nil, []interface{}{1, 2, 3})
+	require.NoError(t, err)
+
+	want := appendAvroLong(nil, 3)
+	for _, n := range []int64{1, 2, 3} {
+		want = append(want, appendAvroLong(nil, avroUnionLong)...)
+		want = append(want, appendAvroLong(nil, n)...)
+	}
+	want = append(want, appendAvroLong(nil, 0)...)
+	assert.Equal(t, want, data)
+}
+
+func TestAvroEncoderUnsupportedValueType(t *testing.T) {
+	_, err := appendAvroUnion(nil, struct{}{})
+	assert.Error(t, err)
+}
+
+func TestAvroEncoderUnsupportedMapKeyType(t *testing.T) {
+	_, err := appendAvroMap(nil, map[interface{}]interface{}{42: "x"})
+	assert.Error(t, err)
+}
@@ -0,0 +1,56 @@
+// Copyright 2019 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//	http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package firehose
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCBOREncoderEmptyMap(t *testing.T) {
+	data, err := cborEncoder{}.Encode(map[interface{}]interface{}{})
+	require.NoError(t, err)
+	assert.Equal(t, []byte{cborMajorMap}, data, "empty map should encode with a 0-length argument")
+}
+
+func TestCBOREncoderTextString(t *testing.T) {
+	data, err := appendCBORValue(nil, "hi")
+	require.NoError(t, err)
+	assert.Equal(t, append([]byte{cborMajorTStr | 2}, "hi"...), data)
+}
+
+func TestCBOREncoderUnsignedInt(t *testing.T) {
+	data, err := appendCBORValue(nil, 10)
+	require.NoError(t, err)
+	assert.Equal(t, []byte{0x0a}, data)
+}
+
+func TestCBOREncoderNegativeInt(t *testing.T) {
+	data, err := appendCBORValue(nil, -1)
+	require.NoError(t, err)
+	assert.Equal(t, []byte{cborMajorNint}, data, "-1 encodes as negative major type with argument 0")
+}
+
+func TestCBOREncoderArray(t *testing.T) {
+	data, err := appendCBORValue(nil, []interface{}{1, 2, 3})
+	require.NoError(t, err)
+	assert.Equal(t, []byte{cborMajorArr | 3, 1, 2, 3}, data)
+}
+
+func TestCBOREncoderUnsupportedType(t *testing.T) {
+	_, err := appendCBORValue(nil, struct{}{})
+	assert.Error(t, err)
+}
@@ -0,0 +1,55 @@
+// Copyright 2019 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//	http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package firehose
+
+import (
+	"fmt"
+
+	"github.com/aws/amazon-kinesis-firehose-for-fluent-bit/plugins"
+	jsoniter "github.com/json-iterator/go"
+)
+
+// jsonEncoder marshals the whole record as a single line of JSON, the
+// plugin's original and default behavior
+type jsonEncoder struct{}
+
+func (jsonEncoder) Encode(record map[interface{}]interface{}) ([]byte, error) {
+	var json = jsoniter.ConfigCompatibleWithStandardLibrary
+	data, err := json.Marshal(record)
+	if err != nil {
+		return nil, err
+	}
+	return append(data, '\n'), nil
+}
+
+// rawEncoder emits a record's single field verbatim, with no JSON
+// envelope. It is meant for records that already carry one fully
+// serialized log line, such as those produced by Fluent Bit's raw or
+// regex parsers.
+type rawEncoder struct{}
+
+func (rawEncoder) Encode(record map[interface{}]interface{}) ([]byte, error) {
+	if len(record) != 1 {
+		return nil, fmt.Errorf("format \"raw\" requires records with exactly one field, got %d; use data_keys or log_key to select one", len(record))
+	}
+
+	for _, v := range record {
+		data, err := plugins.EncodeLogKey(&v)
+		if err != nil {
+			return nil, err
+		}
+		return append(data, '\n'), nil
+	}
+	panic("unreachable")
+}
@@ -0,0 +1,38 @@
+// Copyright 2019 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//	http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package firehose
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestJSONEncoderAppendsNewline(t *testing.T) {
+	data, err := jsonEncoder{}.Encode(map[interface{}]interface{}{"a": "b"})
+	require.NoError(t, err)
+	assert.Equal(t, "{\"a\":\"b\"}\n", string(data))
+}
+
+func TestRawEncoderSingleField(t *testing.T) {
+	data, err := rawEncoder{}.Encode(map[interface{}]interface{}{"log": "hello world"})
+	require.NoError(t, err)
+	assert.Equal(t, "hello world\n", string(data))
+}
+
+func TestRawEncoderRejectsMultipleFields(t *testing.T) {
+	_, err := rawEncoder{}.Encode(map[interface{}]interface{}{"a": "1", "b": "2"})
+	assert.Error(t, err)
+}
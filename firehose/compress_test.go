@@ -0,0 +1,66 @@
+// Copyright 2019 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//	http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package firehose
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"testing"
+
+	"github.com/golang/snappy"
+	"github.com/klauspost/compress/zstd"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNoneCompressorIsPassthrough(t *testing.T) {
+	data, err := noneCompressor{}.Compress([]byte("hello"))
+	require.NoError(t, err)
+	assert.Equal(t, []byte("hello"), data)
+}
+
+func TestGzipCompressorRoundTrips(t *testing.T) {
+	compressed, err := gzipCompressor{}.Compress([]byte("hello world"))
+	require.NoError(t, err)
+
+	r, err := gzip.NewReader(bytes.NewReader(compressed))
+	require.NoError(t, err)
+	decompressed, err := ioutil.ReadAll(r)
+	require.NoError(t, err)
+
+	assert.Equal(t, "hello world", string(decompressed))
+}
+
+func TestZstdCompressorRoundTrips(t *testing.T) {
+	compressed, err := zstdCompressor{}.Compress([]byte("hello world"))
+	require.NoError(t, err)
+
+	decoder, err := zstd.NewReader(nil)
+	require.NoError(t, err)
+	defer decoder.Close()
+
+	decompressed, err := decoder.DecodeAll(compressed, nil)
+	require.NoError(t, err)
+	assert.Equal(t, "hello world", string(decompressed))
+}
+
+func TestSnappyCompressorRoundTrips(t *testing.T) {
+	compressed, err := snappyCompressor{}.Compress([]byte("hello world"))
+	require.NoError(t, err)
+
+	decompressed, err := snappy.Decode(nil, compressed)
+	require.NoError(t, err)
+	assert.Equal(t, "hello world", string(decompressed))
+}
@@ -0,0 +1,239 @@
+// Copyright 2019 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//	http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package firehose
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials/stscreds"
+	"github.com/aws/aws-sdk-go/aws/endpoints"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	dlqMaxBatchRecords = 500
+	dlqMaxBatchBytes   = 4 * 1024 * 1024
+	dlqFlushInterval   = 10 * time.Second
+)
+
+// s3Putter is the subset of the S3 client the dead-letter sink needs,
+// letting tests substitute a fake instead of making real network calls
+type s3Putter interface {
+	PutObject(input *s3.PutObjectInput) (*s3.PutObjectOutput, error)
+}
+
+// s3DeadLetterSink batches records that have exhausted their Firehose
+// delivery attempts and uploads them to S3 as a single gzip-compressed
+// object, so they are not silently lost. Records reach the sink already
+// encoded and compressed per the plugin's format/compression settings (and,
+// under KPL aggregation, already wrapped in a KPL aggregate), so their raw
+// bytes are not text, let alone newline-delimited JSON, in the general
+// case. Each record is therefore stored with a 4-byte big-endian length
+// prefix rather than a delimiter, so it can always be split back out
+// byte-exact regardless of format; an operator inspecting the object needs
+// to know the delivery stream's configured format/compression/aggregation
+// to decode it.
+type s3DeadLetterSink struct {
+	client         s3Putter
+	bucket         string
+	prefix         string
+	deliveryStream string
+	pluginID       int
+
+	mu      sync.Mutex
+	pending [][]byte
+	size    int
+}
+
+// newS3DeadLetterSink builds a dead-letter sink for deliveryStream, using
+// the same credential chain as the Firehose client: an optional
+// EKS_POD_EXECUTION_ROLE pod identity, optionally chained through roleARN.
+func newS3DeadLetterSink(bucket, prefix, roleARN, region, stsEndpoint, deliveryStream string, pluginID int) (*s3DeadLetterSink, error) {
+	sess, err := newDLQSession(roleARN, region, stsEndpoint, pluginID)
+	if err != nil {
+		return nil, err
+	}
+
+	sink := &s3DeadLetterSink{
+		client:         s3.New(sess),
+		bucket:         bucket,
+		prefix:         prefix,
+		deliveryStream: deliveryStream,
+		pluginID:       pluginID,
+	}
+	go sink.flushPeriodically()
+	return sink, nil
+}
+
+func newDLQSession(roleARN, region, stsEndpoint string, pluginID int) (*session.Session, error) {
+	customResolverFn := func(service, region string, optFns ...func(*endpoints.Options)) (endpoints.ResolvedEndpoint, error) {
+		if service == endpoints.StsServiceID && stsEndpoint != "" {
+			return endpoints.ResolvedEndpoint{
+				URL: stsEndpoint,
+			}, nil
+		}
+		return endpoints.DefaultResolver().EndpointFor(service, region, optFns...)
+	}
+
+	baseConfig := &aws.Config{
+		Region:                        aws.String(region),
+		EndpointResolver:              endpoints.ResolverFunc(customResolverFn),
+		CredentialsChainVerboseErrors: aws.Bool(true),
+	}
+
+	sess, err := session.NewSession(baseConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	svcSess := sess
+	if eksRole := os.Getenv("EKS_POD_EXECUTION_ROLE"); eksRole != "" {
+		logrus.Debugf("[firehose %d] Fetching EKS pod credentials for DLQ uploads.\n", pluginID)
+		eksConfig := &aws.Config{
+			Region:      aws.String(region),
+			Credentials: stscreds.NewCredentials(svcSess, eksRole),
+		}
+
+		svcSess, err = session.NewSession(eksConfig)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if roleARN != "" {
+		logrus.Debugf("[firehose %d] Fetching credentials for %s for DLQ uploads.\n", pluginID, roleARN)
+		stsConfig := &aws.Config{
+			Region:      aws.String(region),
+			Credentials: stscreds.NewCredentials(svcSess, roleARN),
+		}
+
+		svcSess, err = session.NewSession(stsConfig)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return svcSess, nil
+}
+
+// Write adds an already-encoded record to the pending batch, flushing
+// immediately if the batch is now full
+func (sink *s3DeadLetterSink) Write(data []byte) {
+	sink.mu.Lock()
+	sink.pending = append(sink.pending, data)
+	sink.size += len(data)
+	full := len(sink.pending) >= dlqMaxBatchRecords || sink.size >= dlqMaxBatchBytes
+	sink.mu.Unlock()
+
+	if full {
+		sink.Flush()
+	}
+}
+
+func (sink *s3DeadLetterSink) flushPeriodically() {
+	ticker := time.NewTicker(dlqFlushInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		sink.Flush()
+	}
+}
+
+// Flush uploads the pending batch, if any, as a single gzip-compressed
+// object keyed by prefix/YYYY/MM/DD/HH/<deliveryStream>-<id>.records.gz
+func (sink *s3DeadLetterSink) Flush() {
+	sink.mu.Lock()
+	batch := sink.pending
+	sink.pending = nil
+	sink.size = 0
+	sink.mu.Unlock()
+
+	if len(batch) == 0 {
+		return
+	}
+
+	body, err := gzipLengthPrefixedRecords(batch)
+	if err != nil {
+		logrus.Errorf("[firehose %d] Failed to gzip dead-letter batch: %v\n", sink.pluginID, err)
+		return
+	}
+
+	id, err := randomID()
+	if err != nil {
+		logrus.Errorf("[firehose %d] Failed to generate dead-letter object key: %v\n", sink.pluginID, err)
+		return
+	}
+
+	key := sink.objectKey(time.Now(), id)
+	_, err = sink.client.PutObject(&s3.PutObjectInput{
+		Bucket: aws.String(sink.bucket),
+		Key:    aws.String(key),
+		Body:   bytes.NewReader(body),
+	})
+	if err != nil {
+		logrus.Errorf("[firehose %d] Failed to upload %d dead-lettered records to s3://%s/%s: %v\n", sink.pluginID, len(batch), sink.bucket, key, err)
+		return
+	}
+	logrus.Warnf("[firehose %d] Wrote %d permanently-failed records to s3://%s/%s\n", sink.pluginID, len(batch), sink.bucket, key)
+}
+
+func (sink *s3DeadLetterSink) objectKey(t time.Time, id string) string {
+	datePath := t.UTC().Format("2006/01/02/15")
+	prefix := strings.Trim(sink.prefix, "/")
+	if prefix == "" {
+		return fmt.Sprintf("%s/%s-%s.records.gz", datePath, sink.deliveryStream, id)
+	}
+	return fmt.Sprintf("%s/%s/%s-%s.records.gz", prefix, datePath, sink.deliveryStream, id)
+}
+
+// gzipLengthPrefixedRecords gzips records as a sequence of
+// (4-byte big-endian length, raw bytes) frames, so records can be split
+// back out exactly regardless of their format, compression, or aggregation
+// rather than relying on a delimiter that only some formats happen to have.
+func gzipLengthPrefixedRecords(records [][]byte) ([]byte, error) {
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	var lengthPrefix [4]byte
+	for _, record := range records {
+		binary.BigEndian.PutUint32(lengthPrefix[:], uint32(len(record)))
+		if _, err := w.Write(lengthPrefix[:]); err != nil {
+			return nil, err
+		}
+		if _, err := w.Write(record); err != nil {
+			return nil, err
+		}
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func randomID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
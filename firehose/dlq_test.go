@@ -0,0 +1,120 @@
+// Copyright 2019 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//	http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package firehose
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// unframeLengthPrefixedRecords reverses gzipLengthPrefixedRecords, for
+// asserting on what a DLQ consumer would actually read back
+func unframeLengthPrefixedRecords(t *testing.T, gzipped []byte) [][]byte {
+	t.Helper()
+
+	r, err := gzip.NewReader(bytes.NewReader(gzipped))
+	require.NoError(t, err)
+	decompressed, err := ioutil.ReadAll(r)
+	require.NoError(t, err)
+
+	var records [][]byte
+	for len(decompressed) > 0 {
+		require.GreaterOrEqual(t, len(decompressed), 4, "truncated length prefix")
+		length := binary.BigEndian.Uint32(decompressed[:4])
+		decompressed = decompressed[4:]
+		require.GreaterOrEqual(t, uint32(len(decompressed)), length, "truncated record body")
+		records = append(records, decompressed[:length])
+		decompressed = decompressed[length:]
+	}
+	return records
+}
+
+// fakeS3Putter records PutObject calls instead of making network requests
+type fakeS3Putter struct {
+	puts []*s3.PutObjectInput
+}
+
+func (f *fakeS3Putter) PutObject(input *s3.PutObjectInput) (*s3.PutObjectOutput, error) {
+	f.puts = append(f.puts, input)
+	return &s3.PutObjectOutput{}, nil
+}
+
+func TestS3DeadLetterSinkObjectKeyWithPrefix(t *testing.T) {
+	sink := &s3DeadLetterSink{bucket: "b", prefix: "/dlq/", deliveryStream: "my-stream"}
+	when := time.Date(2022, time.March, 4, 5, 0, 0, 0, time.UTC)
+	assert.Equal(t, "dlq/2022/03/04/05/my-stream-abc.records.gz", sink.objectKey(when, "abc"))
+}
+
+func TestS3DeadLetterSinkObjectKeyWithoutPrefix(t *testing.T) {
+	sink := &s3DeadLetterSink{bucket: "b", deliveryStream: "my-stream"}
+	when := time.Date(2022, time.March, 4, 5, 0, 0, 0, time.UTC)
+	assert.Equal(t, "2022/03/04/05/my-stream-abc.records.gz", sink.objectKey(when, "abc"))
+}
+
+func TestS3DeadLetterSinkFlushUploadsGzippedLengthPrefixedRecords(t *testing.T) {
+	fake := &fakeS3Putter{}
+	sink := &s3DeadLetterSink{client: fake, bucket: "my-bucket", prefix: "dlq", deliveryStream: "my-stream"}
+
+	// A mix of a JSON record, an arbitrary binary blob (standing in for a
+	// msgpack/cbor/avro-encoded or already-compressed record), and a record
+	// containing an embedded newline, none of which a newline-delimited
+	// format could tell apart.
+	sink.Write([]byte("{\"a\":1}\n"))
+	sink.Write([]byte{0x00, 0x0a, 0xff, 0x01})
+	sink.Write([]byte("line one\nline two"))
+	sink.Flush()
+
+	require.Len(t, fake.puts, 1)
+	put := fake.puts[0]
+	assert.Equal(t, "my-bucket", *put.Bucket)
+	assert.Contains(t, *put.Key, "dlq/")
+	assert.Contains(t, *put.Key, "my-stream-")
+
+	body, err := ioutil.ReadAll(put.Body.(*bytes.Reader))
+	require.NoError(t, err)
+
+	records := unframeLengthPrefixedRecords(t, body)
+	require.Len(t, records, 3)
+	assert.Equal(t, []byte("{\"a\":1}\n"), records[0])
+	assert.Equal(t, []byte{0x00, 0x0a, 0xff, 0x01}, records[1])
+	assert.Equal(t, []byte("line one\nline two"), records[2])
+}
+
+func TestS3DeadLetterSinkFlushIsNoOpWhenEmpty(t *testing.T) {
+	fake := &fakeS3Putter{}
+	sink := &s3DeadLetterSink{client: fake, bucket: "my-bucket", deliveryStream: "my-stream"}
+
+	sink.Flush()
+
+	assert.Empty(t, fake.puts)
+}
+
+func TestS3DeadLetterSinkWriteFlushesWhenBatchIsFull(t *testing.T) {
+	fake := &fakeS3Putter{}
+	sink := &s3DeadLetterSink{client: fake, bucket: "my-bucket", deliveryStream: "my-stream"}
+
+	for i := 0; i < dlqMaxBatchRecords; i++ {
+		sink.Write([]byte("x\n"))
+	}
+
+	require.Len(t, fake.puts, 1, "reaching the max batch record count should trigger an immediate flush")
+}
@@ -0,0 +1,100 @@
+// Copyright 2019 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//	http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package firehose
+
+import (
+	"fmt"
+	"sync"
+)
+
+// Encoder converts a decoded Fluent Bit record into the bytes that will be
+// sent to Firehose for a record, in a particular wire format
+type Encoder interface {
+	Encode(record map[interface{}]interface{}) ([]byte, error)
+}
+
+// Compressor compresses the bytes of a record before it is added to the
+// current Firehose batch
+type Compressor interface {
+	Compress(data []byte) ([]byte, error)
+}
+
+var (
+	registryMu  sync.RWMutex
+	encoders    = make(map[string]Encoder)
+	compressors = make(map[string]Compressor)
+)
+
+// RegisterEncoder makes an Encoder available under name for the plugin's
+// `format` parameter. Third-party builds can call this from their own
+// init() to add formats, such as Avro against a real schema registry,
+// without patching this package.
+func RegisterEncoder(name string, encoder Encoder) {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+	encoders[name] = encoder
+}
+
+// RegisterCompressor makes a Compressor available under name for the
+// plugin's `compression` parameter
+func RegisterCompressor(name string, compressor Compressor) {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+	compressors[name] = compressor
+}
+
+// GetEncoder looks up a previously registered Encoder by name. An empty
+// name resolves to the default "json" encoder.
+func GetEncoder(name string) (Encoder, error) {
+	if name == "" {
+		name = "json"
+	}
+
+	registryMu.RLock()
+	defer registryMu.RUnlock()
+	encoder, ok := encoders[name]
+	if !ok {
+		return nil, fmt.Errorf("no encoder registered for format %q", name)
+	}
+	return encoder, nil
+}
+
+// GetCompressor looks up a previously registered Compressor by name. An
+// empty name resolves to the default "none" (no-op) compressor.
+func GetCompressor(name string) (Compressor, error) {
+	if name == "" {
+		name = "none"
+	}
+
+	registryMu.RLock()
+	defer registryMu.RUnlock()
+	compressor, ok := compressors[name]
+	if !ok {
+		return nil, fmt.Errorf("no compressor registered for compression %q", name)
+	}
+	return compressor, nil
+}
+
+func init() {
+	RegisterEncoder("json", jsonEncoder{})
+	RegisterEncoder("raw", rawEncoder{})
+	RegisterEncoder("msgpack", msgpackEncoder{})
+	RegisterEncoder("cbor", cborEncoder{})
+	RegisterEncoder("avro", avroEncoder{})
+
+	RegisterCompressor("none", noneCompressor{})
+	RegisterCompressor("gzip", gzipCompressor{})
+	RegisterCompressor("zstd", zstdCompressor{})
+	RegisterCompressor("snappy", snappyCompressor{})
+}
@@ -0,0 +1,66 @@
+// Copyright 2019 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//	http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package firehose
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGetEncoderDefaultsToJSON(t *testing.T) {
+	encoder, err := GetEncoder("")
+	require.NoError(t, err)
+	assert.IsType(t, jsonEncoder{}, encoder)
+}
+
+func TestGetEncoderUnknownFormat(t *testing.T) {
+	_, err := GetEncoder("bogus-format")
+	assert.Error(t, err)
+}
+
+func TestGetEncoderKnownFormats(t *testing.T) {
+	for _, name := range []string{"json", "raw", "msgpack", "cbor", "avro"} {
+		_, err := GetEncoder(name)
+		assert.NoError(t, err, "format %q should be registered", name)
+	}
+}
+
+func TestGetCompressorKnownCompressions(t *testing.T) {
+	for _, name := range []string{"none", "gzip", "zstd", "snappy"} {
+		_, err := GetCompressor(name)
+		assert.NoError(t, err, "compression %q should be registered", name)
+	}
+}
+
+func TestGetCompressorDefaultsToNone(t *testing.T) {
+	compressor, err := GetCompressor("")
+	require.NoError(t, err)
+	assert.IsType(t, noneCompressor{}, compressor)
+}
+
+func TestGetCompressorUnknownCompression(t *testing.T) {
+	_, err := GetCompressor("bogus-compression")
+	assert.Error(t, err)
+}
+
+func TestRegisterEncoderOverridesLookup(t *testing.T) {
+	RegisterEncoder("test-custom", jsonEncoder{})
+	defer RegisterEncoder("test-custom", nil)
+
+	encoder, err := GetEncoder("test-custom")
+	require.NoError(t, err)
+	assert.IsType(t, jsonEncoder{}, encoder)
+}
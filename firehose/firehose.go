@@ -19,6 +19,7 @@ import (
 	"fmt"
 	"os"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/aws/amazon-kinesis-firehose-for-fluent-bit/plugins"
@@ -29,7 +30,6 @@ import (
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/firehose"
 	fluentbit "github.com/fluent/fluent-bit-go/output"
-	jsoniter "github.com/json-iterator/go"
 	"github.com/lestrrat-go/strftime"
 	"github.com/sirupsen/logrus"
 )
@@ -54,29 +54,96 @@ type PutRecordBatcher interface {
 
 // OutputPlugin sends log records to firehose
 type OutputPlugin struct {
-	region                       string
-	deliveryStream               string
-	dataKeys                     string
-	timeKey                      string
-	fmtStrftime                  *strftime.Strftime
-	logKey                       string
-	client                       PutRecordBatcher
-	records                      []*firehose.Record
-	dataLength                   int
-	timer                        *plugins.Timeout
-	PluginID                     int
-	replaceDots                  string
-	simpleAggregation            bool
+	region         string
+	deliveryStream string
+	dataKeys       string
+	timeKey        string
+	fmtStrftime    *strftime.Strftime
+	logKey         string
+	client         PutRecordBatcher
+	records        []*firehose.Record
+	spoolPaths     [][]string
+	recordAttempts []int
+	spool          *diskSpool
+	dataLength     int
+	timer          *plugins.Timeout
+	PluginID       int
+	replaceDots    string
+	aggregation    string
+	kplAggregator  *kplAggregator
+	kplSpoolPaths  []string
+	encoder        Encoder
+	compressor     Compressor
+
+	// dlqSink, when configured, receives records dropped after more than
+	// dlqMaxAttempts failed delivery attempts instead of being discarded
+	dlqSink        *s3DeadLetterSink
+	dlqMaxAttempts int
+
+	// concurrency controls the size of the flush worker pool. A value of 1
+	// (the default) preserves the original behavior of sending each batch
+	// synchronously on the calling goroutine.
+	concurrency    int
+	batchCh        chan *batchJob
+	workerTimers   []*plugins.Timeout
+	givenUpWorkers map[int]bool
+	givenUpMu      sync.Mutex
+
+	// retryRecords holds records that failed a worker's backoff/retry loop,
+	// kept separate from records so they don't block newly arriving data
+	retryMu         sync.Mutex
+	retryRecords    []*firehose.Record
+	retrySpoolPaths [][]string
+	retryAttempts   []int
 }
 
-// NewOutputPlugin creates an OutputPlugin object
-func NewOutputPlugin(region, deliveryStream, dataKeys, roleARN, firehoseEndpoint, stsEndpoint, timeKey, timeFmt, logKey, replaceDots string, pluginID int, simpleAggregation bool) (*OutputPlugin, error) {
+// NewOutputPlugin creates an OutputPlugin object. aggregation selects how
+// multiple user records are packed into a single Firehose record: "" sends
+// one Firehose record per user record, "simple" concatenates their raw
+// bytes, and "kpl" packs them using the Kinesis Producer Library's
+// protobuf wire format so a KCL-based consumer can deaggregate them.
+// format and compression select the Encoder and Compressor, by name, that
+// turn each record into bytes before it is buffered; both default to the
+// plugin's original behavior ("json" and "none") when empty. Additional
+// formats and compressors can be added by a third-party build calling
+// RegisterEncoder/RegisterCompressor from its own init().
+// dlqS3Bucket, if non-empty, enables a dead-letter sink: records that are
+// still failing after dlqMaxAttempts delivery attempts (or maxRetryAttempts,
+// if dlqMaxAttempts is 0) are uploaded to that bucket instead of being
+// dropped.
+func NewOutputPlugin(region, deliveryStream, dataKeys, roleARN, firehoseEndpoint, stsEndpoint, timeKey, timeFmt, logKey, replaceDots, bufferDir, aggregation, format, compression string, bufferMaxBytes int64, bufferMaxAge time.Duration, pluginID, concurrency int, dlqS3Bucket, dlqS3Prefix string, dlqMaxAttempts int) (*OutputPlugin, error) {
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	if dlqMaxAttempts <= 0 {
+		dlqMaxAttempts = maxRetryAttempts
+	}
 	client, err := newPutRecordBatcher(roleARN, region, firehoseEndpoint, stsEndpoint, pluginID)
 	if err != nil {
 		return nil, err
 	}
 
+	encoder, err := GetEncoder(format)
+	if err != nil {
+		return nil, err
+	}
+
+	compressor, err := GetCompressor(compression)
+	if err != nil {
+		return nil, err
+	}
+
+	var dlqSink *s3DeadLetterSink
+	if dlqS3Bucket != "" {
+		dlqSink, err = newS3DeadLetterSink(dlqS3Bucket, dlqS3Prefix, roleARN, region, stsEndpoint, deliveryStream, pluginID)
+		if err != nil {
+			return nil, err
+		}
+	}
+
 	records := make([]*firehose.Record, 0, maximumRecordsPerPut)
+	spoolPaths := make([][]string, 0, maximumRecordsPerPut)
+	recordAttempts := make([]int, 0, maximumRecordsPerPut)
 
 	timer, err := plugins.NewTimeout(func(d time.Duration) {
 		logrus.Errorf("[firehose %d] timeout threshold reached: Failed to send logs for %s\n", pluginID, d.String())
@@ -100,20 +167,89 @@ func NewOutputPlugin(region, deliveryStream, dataKeys, roleARN, firehoseEndpoint
 		}
 	}
 
-	return &OutputPlugin{
-		region:                        region,
-		deliveryStream:                deliveryStream,
-		client:                        client,
-		records:                       records,
-		dataKeys:                      dataKeys,
-		timer:                         timer,
-		timeKey:                       timeKey,
-		fmtStrftime:                   timeFormatter,
-		logKey:                        logKey,
-		PluginID:                      pluginID,
-		replaceDots:                   replaceDots,
-		simpleAggregation:             simpleAggregation,
-	}, nil
+	spool, err := newDiskSpool(bufferDir, bufferMaxBytes, bufferMaxAge, pluginID)
+	if err != nil {
+		return nil, err
+	}
+
+	output := &OutputPlugin{
+		region:         region,
+		deliveryStream: deliveryStream,
+		client:         client,
+		records:        records,
+		spoolPaths:     spoolPaths,
+		recordAttempts: recordAttempts,
+		spool:          spool,
+		dataKeys:       dataKeys,
+		timer:          timer,
+		timeKey:        timeKey,
+		fmtStrftime:    timeFormatter,
+		logKey:         logKey,
+		PluginID:       pluginID,
+		replaceDots:    replaceDots,
+		aggregation:    aggregation,
+		encoder:        encoder,
+		compressor:     compressor,
+		dlqSink:        dlqSink,
+		dlqMaxAttempts: dlqMaxAttempts,
+		concurrency:    concurrency,
+		givenUpWorkers: make(map[int]bool),
+	}
+
+	if aggregation == "kpl" {
+		output.kplAggregator = newKPLAggregator()
+	}
+
+	output.workerTimers = make([]*plugins.Timeout, concurrency)
+	for i := 0; i < concurrency; i++ {
+		workerTimer, err := newWorkerTimeout(output, i)
+		if err != nil {
+			return nil, err
+		}
+		output.workerTimers[i] = workerTimer
+	}
+	output.startWorkers()
+
+	// Replayed last, since it may flush full batches through
+	// sendCurrentBatch, which for concurrency > 1 requires the worker pool
+	// above to already be running
+	if spool != nil {
+		output.replaySpool()
+	}
+
+	return output, nil
+}
+
+// replaySpool loads any records left on disk by a previous process and
+// re-queues them as the first records of the in-memory batch, so they are
+// not lost across a restart. Pending records are fed through the same
+// maximumRecordsPerPut/maximumPutRecordBatchSize threshold check AddRecord
+// uses, flushing a batch via sendCurrentBatch whenever it would otherwise
+// grow past what a single PutRecordBatch call allows, since a crash can
+// easily leave more than one batch's worth of data spooled on disk.
+func (output *OutputPlugin) replaySpool() {
+	pending, err := output.spool.Pending()
+	if err != nil {
+		logrus.Errorf("[firehose %d] Failed to scan buffer_dir: %v\n", output.PluginID, err)
+		return
+	}
+
+	for _, rec := range pending {
+		if len(output.records) == maximumRecordsPerPut || (output.dataLength+len(rec.data)) > maximumPutRecordBatchSize {
+			if _, err := output.sendCurrentBatch(); err != nil {
+				logrus.Errorf("[firehose %d] %v\n", output.PluginID, err)
+			}
+		}
+
+		output.records = append(output.records, &firehose.Record{Data: rec.data})
+		output.spoolPaths = append(output.spoolPaths, []string{rec.path})
+		output.recordAttempts = append(output.recordAttempts, 0)
+		output.dataLength += len(rec.data)
+	}
+
+	if len(pending) > 0 {
+		logrus.Infof("[firehose %d] Replayed %d spooled records from %s\n", output.PluginID, len(pending), output.spool.dir)
+	}
 }
 
 func newPutRecordBatcher(roleARN, region, firehoseEndpoint, stsEndpoint string, pluginID int) (*firehose.Firehose, error) {
@@ -197,6 +333,14 @@ func (output *OutputPlugin) AddRecord(record map[interface{}]interface{}, timeSt
 		return fluentbit.FLB_OK
 	}
 
+	var spoolPath string
+	if output.spool != nil {
+		spoolPath, err = output.spool.Write(data)
+		if err != nil {
+			logrus.Errorf("[firehose %d] Failed to spool record to buffer_dir: %v\n", output.PluginID, err)
+		}
+	}
+
 	newDataSize := len(data)
 
 	if len(output.records) == maximumRecordsPerPut || (output.dataLength+newDataSize) > maximumPutRecordBatchSize {
@@ -204,29 +348,75 @@ func (output *OutputPlugin) AddRecord(record map[interface{}]interface{}, timeSt
 		if err != nil {
 			logrus.Errorf("[firehose %d] %v\n", output.PluginID, err)
 		}
-		if retCode != fluentbit.FLB_OK {
+		// With a disk spool, the record above is already safely on disk, so
+		// we can keep accepting new data instead of blocking the pipeline
+		// on a retry of the batch that just failed.
+		if retCode != fluentbit.FLB_OK && output.spool == nil {
 			return retCode
 		}
 	}
 
-    if output.simpleAggregation && len(output.records) > 0 && len(output.records[len(output.records)-1].Data) + newDataSize <= maximumRecordSize {
-        output.records[len(output.records)-1].Data = append(output.records[len(output.records)-1].Data, data...)
-    } else {
-        output.records = append(output.records, &firehose.Record{
-            Data: data,
-        })
+	switch output.aggregation {
+	case "kpl":
+		// Firehose records carry no partition key of their own, so every
+		// user record is interned under the same placeholder key; it only
+		// needs to be present for the KCL deaggregator to accept the format.
+		if output.kplAggregator.WouldExceed("", data, maximumRecordSize) {
+			output.finalizeKPLAggregate()
+		}
+		output.kplAggregator.Add("", data)
+		output.kplSpoolPaths = append(output.kplSpoolPaths, spoolPath)
+	case "simple":
+		if len(output.records) > 0 && len(output.records[len(output.records)-1].Data)+newDataSize <= maximumRecordSize {
+			output.records[len(output.records)-1].Data = append(output.records[len(output.records)-1].Data, data...)
+			last := len(output.spoolPaths) - 1
+			output.spoolPaths[last] = append(output.spoolPaths[last], spoolPath)
+		} else {
+			output.records = append(output.records, &firehose.Record{
+				Data: data,
+			})
+			output.spoolPaths = append(output.spoolPaths, []string{spoolPath})
+			output.recordAttempts = append(output.recordAttempts, 0)
+		}
+	default:
+		output.records = append(output.records, &firehose.Record{
+			Data: data,
+		})
+		output.spoolPaths = append(output.spoolPaths, []string{spoolPath})
+		output.recordAttempts = append(output.recordAttempts, 0)
 	}
 	output.dataLength += newDataSize
 	return fluentbit.FLB_OK
 }
 
+// finalizeKPLAggregate packs the pending KPL aggregate into a single
+// Firehose record and appends it to the current batch
+func (output *OutputPlugin) finalizeKPLAggregate() {
+	if output.kplAggregator.Len() == 0 {
+		return
+	}
+
+	output.records = append(output.records, &firehose.Record{
+		Data: output.kplAggregator.Finalize(),
+	})
+	output.spoolPaths = append(output.spoolPaths, output.kplSpoolPaths)
+	output.recordAttempts = append(output.recordAttempts, 0)
+	output.kplSpoolPaths = nil
+}
+
 // Flush sends the current buffer of records
 // Returns FLB_OK, FLB_RETRY, FLB_ERROR
 func (output *OutputPlugin) Flush() int {
+	if output.aggregation == "kpl" {
+		output.finalizeKPLAggregate()
+	}
 	retCode, err := output.sendCurrentBatch()
 	if err != nil {
 		logrus.Errorf("[firehose %d] %v\n", output.PluginID, err)
 	}
+	if output.dlqSink != nil {
+		output.dlqSink.Flush()
+	}
 	return retCode
 }
 
@@ -265,7 +455,6 @@ func (output *OutputPlugin) processRecord(record map[interface{}]interface{}) ([
 		record = replaceDots(record, output.replaceDots)
 	}
 
-	var json = jsoniter.ConfigCompatibleWithStandardLibrary
 	var data []byte
 
 	if output.logKey != "" {
@@ -275,24 +464,31 @@ func (output *OutputPlugin) processRecord(record map[interface{}]interface{}) ([
 		}
 
 		data, err = plugins.EncodeLogKey(log)
+		if err != nil {
+			logrus.Debugf("[firehose %d] Failed to marshal record: %v\n", output.PluginID, record)
+			return nil, err
+		}
+		data = append(data, []byte("\n")...)
 	} else {
-		data, err = json.Marshal(record)
-	}
-
-	if err != nil {
-		logrus.Debugf("[firehose %d] Failed to marshal record: %v\n", output.PluginID, record)
-		return nil, err
+		data, err = output.encoder.Encode(record)
+		if err != nil {
+			logrus.Debugf("[firehose %d] Failed to encode record: %v\n", output.PluginID, record)
+			return nil, err
+		}
 	}
 
-	// append newline
-	data = append(data, []byte("\n")...)
-
 	if len(data) > maximumRecordSize {
 		logrus.Warnf("[firehose %d] Found record with %d bytes, truncating to 1000Kib, stream=%s\n", output.PluginID, len(data), output.deliveryStream)
 		data = data[:maximumRecordSize-len(truncatedSuffix)]
 		data = append(data, []byte(truncatedSuffix)...)
 	}
 
+	data, err = output.compressor.Compress(data)
+	if err != nil {
+		logrus.Debugf("[firehose %d] Failed to compress record: %v\n", output.PluginID, record)
+		return nil, err
+	}
+
 	return data, nil
 }
 
@@ -302,6 +498,45 @@ func (output *OutputPlugin) sendCurrentBatch() (int, error) {
 		return fluentbit.FLB_OK, nil
 	}
 
+	if output.concurrency > 1 {
+		return output.sendBatchConcurrent()
+	}
+
+	return output.sendBatchSync()
+}
+
+// sendBatchConcurrent hands the current batch to the flush worker pool so
+// the calling goroutine isn't blocked on the network round trip, retrying,
+// or backoff. If every worker is busy and the pool's queue, which holds one
+// pending batch per worker, is also full, it falls back to sendBatchSync so
+// a saturated pool still behaves like the single-worker path.
+func (output *OutputPlugin) sendBatchConcurrent() (int, error) {
+	output.flushRetryQueue()
+
+	job := &batchJob{
+		records:    output.records,
+		spoolPaths: output.spoolPaths,
+		attempts:   output.recordAttempts,
+	}
+
+	select {
+	case output.batchCh <- job:
+		output.records = make([]*firehose.Record, 0, maximumRecordsPerPut)
+		output.spoolPaths = make([][]string, 0, maximumRecordsPerPut)
+		output.recordAttempts = make([]int, 0, maximumRecordsPerPut)
+		output.dataLength = 0
+		return fluentbit.FLB_OK, nil
+	default:
+		logrus.Warnf("[firehose %d] All %d flush workers are busy, sending batch synchronously\n", output.PluginID, output.concurrency)
+		return output.sendBatchSync()
+	}
+}
+
+// sendBatchSync sends the current batch on the calling goroutine, exactly
+// as the plugin did before flush workers existed. It is used directly when
+// concurrency is 1, and as the backpressure fallback when the worker pool
+// is saturated.
+func (output *OutputPlugin) sendBatchSync() (int, error) {
 	output.timer.Check()
 
 	response, err := output.client.PutRecordBatch(&firehose.PutRecordBatchInput{
@@ -335,11 +570,26 @@ func (output *OutputPlugin) processAPIResponse(response *firehose.PutRecordBatch
 
 		logrus.Warnf("[firehose %d] %d records failed to be delivered. Will retry.\n", output.PluginID, aws.Int64Value(response.FailedPutCount))
 		failedRecords := make([]*firehose.Record, 0, aws.Int64Value(response.FailedPutCount))
+		failedSpoolPaths := make([][]string, 0, aws.Int64Value(response.FailedPutCount))
+		failedAttempts := make([]int, 0, aws.Int64Value(response.FailedPutCount))
 		// try to resend failed records
 		for i, record := range response.RequestResponses {
 			if record.ErrorMessage != nil {
 				logrus.Debugf("[firehose %d] Record failed to send with error: %s\n", output.PluginID, aws.StringValue(record.ErrorMessage))
-				failedRecords = append(failedRecords, output.records[i])
+
+				attempts := output.recordAttempts[i] + 1
+				if output.dlqSink != nil && attempts > output.dlqMaxAttempts {
+					output.dlqSink.Write(output.records[i].Data)
+					total := incrementDLQDropped()
+					logrus.Errorf("[firehose %d] Dropping record to dead-letter sink after %d failed delivery attempts (%d dropped total)\n", output.PluginID, attempts, total)
+					output.removeSpoolPaths(output.spoolPaths[i])
+				} else {
+					failedRecords = append(failedRecords, output.records[i])
+					failedSpoolPaths = append(failedSpoolPaths, output.spoolPaths[i])
+					failedAttempts = append(failedAttempts, attempts)
+				}
+			} else {
+				output.removeSpoolPaths(output.spoolPaths[i])
 			}
 			if aws.StringValue(record.ErrorCode) == firehose.ErrCodeServiceUnavailableException {
 				logrus.Warnf("[firehose %d] Throughput limits for the delivery stream may have been exceeded.", output.PluginID)
@@ -349,6 +599,10 @@ func (output *OutputPlugin) processAPIResponse(response *firehose.PutRecordBatch
 
 		output.records = output.records[:0]
 		output.records = append(output.records, failedRecords...)
+		output.spoolPaths = output.spoolPaths[:0]
+		output.spoolPaths = append(output.spoolPaths, failedSpoolPaths...)
+		output.recordAttempts = output.recordAttempts[:0]
+		output.recordAttempts = append(output.recordAttempts, failedAttempts...)
 		output.dataLength = 0
 		for _, record := range output.records {
 			output.dataLength += len(record.Data)
@@ -357,9 +611,27 @@ func (output *OutputPlugin) processAPIResponse(response *firehose.PutRecordBatch
 	} else {
 		// request fully succeeded
 		output.timer.Reset()
+		for _, paths := range output.spoolPaths {
+			output.removeSpoolPaths(paths)
+		}
 		output.records = output.records[:0]
+		output.spoolPaths = output.spoolPaths[:0]
+		output.recordAttempts = output.recordAttempts[:0]
 		output.dataLength = 0
 	}
 
 	return fluentbit.FLB_OK, nil
 }
+
+// removeSpoolPaths deletes the on-disk copies backing a record that has
+// been durably delivered to Firehose
+func (output *OutputPlugin) removeSpoolPaths(paths []string) {
+	if output.spool == nil {
+		return
+	}
+	for _, path := range paths {
+		if err := output.spool.Remove(path); err != nil {
+			logrus.Errorf("[firehose %d] Failed to remove spooled record %s: %v\n", output.PluginID, path, err)
+		}
+	}
+}
@@ -0,0 +1,160 @@
+// Copyright 2019 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//	http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package firehose
+
+import (
+	"io/ioutil"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/service/firehose"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/aws/amazon-kinesis-firehose-for-fluent-bit/plugins"
+)
+
+// fakeBatcher records PutRecordBatch calls instead of making network requests
+type fakeBatcher struct {
+	mu    sync.Mutex
+	calls [][]*firehose.Record
+}
+
+func (f *fakeBatcher) PutRecordBatch(input *firehose.PutRecordBatchInput) (*firehose.PutRecordBatchOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.calls = append(f.calls, input.Records)
+	return &firehose.PutRecordBatchOutput{}, nil
+}
+
+func (f *fakeBatcher) callCount() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return len(f.calls)
+}
+
+// newTestOutputPlugin builds an OutputPlugin without going through
+// NewOutputPlugin, so tests don't need a real AWS session
+func newTestOutputPlugin(t *testing.T, client PutRecordBatcher, concurrency int) *OutputPlugin {
+	t.Helper()
+
+	timer, err := plugins.NewTimeout(func(time.Duration) {})
+	require.NoError(t, err)
+
+	output := &OutputPlugin{
+		deliveryStream: "test-stream",
+		client:         client,
+		records:        make([]*firehose.Record, 0, maximumRecordsPerPut),
+		spoolPaths:     make([][]string, 0, maximumRecordsPerPut),
+		recordAttempts: make([]int, 0, maximumRecordsPerPut),
+		timer:          timer,
+		concurrency:    concurrency,
+		givenUpWorkers: make(map[int]bool),
+	}
+
+	output.workerTimers = make([]*plugins.Timeout, concurrency)
+	for i := 0; i < concurrency; i++ {
+		workerTimer, err := newWorkerTimeout(output, i)
+		require.NoError(t, err)
+		output.workerTimers[i] = workerTimer
+	}
+	output.startWorkers()
+
+	return output
+}
+
+func TestReplaySpoolChunksMoreThanOneBatchWorthOfRecords(t *testing.T) {
+	dir, err := ioutil.TempDir("", "replay-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	spool, err := newDiskSpool(dir, 0, 0, 0)
+	require.NoError(t, err)
+
+	recordCount := maximumRecordsPerPut + 10
+	for i := 0; i < recordCount; i++ {
+		_, err := spool.Write([]byte("x"))
+		require.NoError(t, err)
+	}
+
+	fake := &fakeBatcher{}
+	output := newTestOutputPlugin(t, fake, 1)
+	output.spool = spool
+
+	output.replaySpool()
+
+	for _, records := range fake.calls {
+		assert.LessOrEqual(t, len(records), maximumRecordsPerPut, "replaySpool must not send a PutRecordBatch over the 500-record limit")
+	}
+
+	sent := 0
+	for _, records := range fake.calls {
+		sent += len(records)
+	}
+	assert.Equal(t, recordCount-len(output.records), sent, "every flushed record should have gone out in one of the batches")
+	assert.LessOrEqual(t, len(output.records), maximumRecordsPerPut, "the trailing partial batch should stay under the per-put limit")
+}
+
+func TestReplaySpoolLeavesPartialBatchForNextFlush(t *testing.T) {
+	dir, err := ioutil.TempDir("", "replay-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	spool, err := newDiskSpool(dir, 0, 0, 0)
+	require.NoError(t, err)
+
+	_, err = spool.Write([]byte("a"))
+	require.NoError(t, err)
+	_, err = spool.Write([]byte("b"))
+	require.NoError(t, err)
+
+	fake := &fakeBatcher{}
+	output := newTestOutputPlugin(t, fake, 1)
+	output.spool = spool
+
+	output.replaySpool()
+
+	assert.Empty(t, fake.calls, "a small replay should not trigger a flush on its own")
+	require.Len(t, output.records, 2)
+	assert.ElementsMatch(t, [][]byte{[]byte("a"), []byte("b")}, [][]byte{output.records[0].Data, output.records[1].Data})
+}
+
+func TestReplaySpoolChunksOnByteSizeLimit(t *testing.T) {
+	dir, err := ioutil.TempDir("", "replay-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	spool, err := newDiskSpool(dir, 0, 0, 0)
+	require.NoError(t, err)
+
+	// Two records at exactly half the per-put byte limit fit in one batch,
+	// but a third pushes the running total over it and must flush first
+	big := make([]byte, maximumPutRecordBatchSize/2)
+	for i := 0; i < 3; i++ {
+		_, err := spool.Write(big)
+		require.NoError(t, err)
+	}
+
+	fake := &fakeBatcher{}
+	output := newTestOutputPlugin(t, fake, 1)
+	output.spool = spool
+
+	output.replaySpool()
+
+	require.Len(t, fake.calls, 1, "the first two records should have been flushed together once the third would exceed the byte limit")
+	assert.Len(t, fake.calls[0], 2)
+	require.Len(t, output.records, 1, "the third record should remain buffered for the next flush")
+}
@@ -0,0 +1,228 @@
+// Copyright 2019 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//	http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package firehose
+
+import "crypto/md5"
+
+// kplMagicNumber prefixes every record aggregated with the Kinesis Producer
+// Library wire format, so the KCL deaggregator on the consumer side
+// recognizes and unpacks it. See:
+// https://github.com/awslabs/amazon-kinesis-producer/blob/master/aggregation-format.md
+var kplMagicNumber = []byte{0xF3, 0x89, 0x9A, 0xC2}
+
+// AggregatedRecord protobuf field numbers (message.proto from the KPL)
+const (
+	aggPartitionKeyTableField = 1
+	aggRecordsField           = 3
+
+	recordPartitionKeyIndexField = 1
+	recordDataField              = 3
+)
+
+const (
+	protoWireVarint = 0
+	protoWireBytes  = 2
+)
+
+// kplUserRecord is one record packed into a kplAggregator, prior to framing
+type kplUserRecord struct {
+	partitionKeyIndex int
+	data              []byte
+}
+
+// kplAggregator packs multiple user records into a single KPL-compatible
+// AggregatedRecord, so a KCL-based consumer can transparently split them
+// back out. It tracks the protobuf-encoded size incrementally so callers
+// can cheaply check whether one more record would exceed a size limit
+// before finalizing the aggregate.
+type kplAggregator struct {
+	partitionKeyIndex map[string]int
+	partitionKeyTable []string
+	records           []kplUserRecord
+	bodySize          int
+}
+
+func newKPLAggregator() *kplAggregator {
+	return &kplAggregator{partitionKeyIndex: make(map[string]int)}
+}
+
+// Len returns the number of user records accumulated so far
+func (a *kplAggregator) Len() int {
+	return len(a.records)
+}
+
+// Size returns the size, in bytes, that Finalize would currently produce,
+// or 0 while no records have been added
+func (a *kplAggregator) Size() int {
+	if len(a.records) == 0 {
+		return 0
+	}
+	return len(kplMagicNumber) + a.bodySize + md5.Size
+}
+
+// WouldExceed reports whether adding a record with the given partition key
+// and data would push the finalized aggregate past limit. An empty
+// aggregator never reports an overflow, so a single oversized record still
+// gets its own aggregate rather than being dropped.
+func (a *kplAggregator) WouldExceed(partitionKey string, data []byte, limit int) bool {
+	if len(a.records) == 0 {
+		return false
+	}
+	return a.Size()+a.marginalSize(partitionKey, data) > limit
+}
+
+// marginalSize returns how many additional protobuf bytes adding this
+// record would cost: a new partition key table entry, if the key hasn't
+// been seen yet, plus the record entry itself.
+func (a *kplAggregator) marginalSize(partitionKey string, data []byte) int {
+	if partitionKey == "" {
+		partitionKey = "0"
+	}
+	size := recordFieldSize(a.partitionKeyIndexFor(partitionKey, false), data)
+	if _, ok := a.partitionKeyIndex[partitionKey]; !ok {
+		size += stringFieldSize(aggPartitionKeyTableField, partitionKey)
+	}
+	return size
+}
+
+// Add appends a user record to the pending aggregate. An empty partition
+// key is mapped to "0", matching the official KPL's behavior when the
+// caller supplies none.
+func (a *kplAggregator) Add(partitionKey string, data []byte) {
+	if partitionKey == "" {
+		partitionKey = "0"
+	}
+
+	_, alreadyKnown := a.partitionKeyIndex[partitionKey]
+	idx := a.partitionKeyIndexFor(partitionKey, true)
+	if !alreadyKnown {
+		a.bodySize += stringFieldSize(aggPartitionKeyTableField, partitionKey)
+	}
+
+	a.bodySize += recordFieldSize(idx, data)
+	a.records = append(a.records, kplUserRecord{partitionKeyIndex: idx, data: data})
+}
+
+// partitionKeyIndexFor interns a partition key into the table, returning its
+// index. If insert is false, the key is looked up but not added.
+func (a *kplAggregator) partitionKeyIndexFor(key string, insert bool) int {
+	if key == "" {
+		key = "0"
+	}
+	if idx, ok := a.partitionKeyIndex[key]; ok {
+		return idx
+	}
+	idx := len(a.partitionKeyTable)
+	if insert {
+		a.partitionKeyIndex[key] = idx
+		a.partitionKeyTable = append(a.partitionKeyTable, key)
+	}
+	return idx
+}
+
+// Finalize serializes the accumulated records as a single KPL-framed
+// record: the magic number, the AggregatedRecord protobuf body, and a
+// trailing MD5 checksum of that body. The aggregator is left empty
+// afterwards so it can be reused for the next aggregate.
+func (a *kplAggregator) Finalize() []byte {
+	body := make([]byte, 0, a.bodySize)
+	for _, key := range a.partitionKeyTable {
+		body = appendStringField(body, aggPartitionKeyTableField, key)
+	}
+	for _, rec := range a.records {
+		body = appendRecordField(body, rec.partitionKeyIndex, rec.data)
+	}
+
+	sum := md5.Sum(body)
+	out := make([]byte, 0, len(kplMagicNumber)+len(body)+md5.Size)
+	out = append(out, kplMagicNumber...)
+	out = append(out, body...)
+	out = append(out, sum[:]...)
+
+	a.partitionKeyIndex = make(map[string]int)
+	a.partitionKeyTable = nil
+	a.records = nil
+	a.bodySize = 0
+
+	return out
+}
+
+// recordFieldSize returns the encoded size of a Record message packed as
+// field aggRecordsField of the AggregatedRecord
+func recordFieldSize(partitionKeyIndex int, data []byte) int {
+	inner := varintFieldSize(recordPartitionKeyIndexField, uint64(partitionKeyIndex)) + bytesFieldSize(recordDataField, len(data))
+	return bytesFieldSize(aggRecordsField, inner)
+}
+
+func appendRecordField(buf []byte, partitionKeyIndex int, data []byte) []byte {
+	inner := appendVarintField(nil, recordPartitionKeyIndexField, uint64(partitionKeyIndex))
+	inner = appendBytesField(inner, recordDataField, data)
+	return appendBytesField(buf, aggRecordsField, inner)
+}
+
+func stringFieldSize(fieldNum int, s string) int {
+	return bytesFieldSize(fieldNum, len(s))
+}
+
+func appendStringField(buf []byte, fieldNum int, s string) []byte {
+	return appendBytesField(buf, fieldNum, []byte(s))
+}
+
+// bytesFieldSize returns the encoded size of a length-delimited field: the
+// tag, the varint-encoded length, and the payload itself
+func bytesFieldSize(fieldNum, length int) int {
+	return tagSize(fieldNum, protoWireBytes) + varintSize(uint64(length)) + length
+}
+
+func appendBytesField(buf []byte, fieldNum int, data []byte) []byte {
+	buf = appendTag(buf, fieldNum, protoWireBytes)
+	buf = appendVarint(buf, uint64(len(data)))
+	return append(buf, data...)
+}
+
+func varintFieldSize(fieldNum int, v uint64) int {
+	return tagSize(fieldNum, protoWireVarint) + varintSize(v)
+}
+
+func appendVarintField(buf []byte, fieldNum int, v uint64) []byte {
+	buf = appendTag(buf, fieldNum, protoWireVarint)
+	return appendVarint(buf, v)
+}
+
+func tagSize(fieldNum, wireType int) int {
+	return varintSize(uint64(fieldNum)<<3 | uint64(wireType))
+}
+
+func appendTag(buf []byte, fieldNum, wireType int) []byte {
+	return appendVarint(buf, uint64(fieldNum)<<3|uint64(wireType))
+}
+
+// varintSize returns the number of bytes v would occupy LEB128-encoded
+func varintSize(v uint64) int {
+	n := 1
+	for v >= 0x80 {
+		v >>= 7
+		n++
+	}
+	return n
+}
+
+// appendVarint appends v to buf using protobuf's base-128 varint encoding
+func appendVarint(buf []byte, v uint64) []byte {
+	for v >= 0x80 {
+		buf = append(buf, byte(v)|0x80)
+		v >>= 7
+	}
+	return append(buf, byte(v))
+}
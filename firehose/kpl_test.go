@@ -0,0 +1,150 @@
+// Copyright 2019 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//	http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package firehose
+
+import (
+	"bytes"
+	"crypto/md5"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// decodedKPLRecord is the minimal view of a KPL AggregatedRecord's Record
+// entries needed to assert Finalize's output, decoded with a small
+// protobuf reader rather than pulling in a generated message package
+type decodedKPLRecord struct {
+	partitionKeyIndex uint64
+	data              []byte
+}
+
+func decodeKPLAggregate(t *testing.T, raw []byte) (partitionKeys []string, records []decodedKPLRecord) {
+	t.Helper()
+	require.True(t, bytes.HasPrefix(raw, kplMagicNumber), "missing KPL magic number")
+
+	body := raw[len(kplMagicNumber) : len(raw)-md5.Size]
+	checksum := raw[len(raw)-md5.Size:]
+	want := md5.Sum(body)
+	require.True(t, bytes.Equal(checksum, want[:]), "checksum does not match body")
+
+	buf := body
+	for len(buf) > 0 {
+		tag, n := readVarint(t, buf)
+		buf = buf[n:]
+		fieldNum, wireType := int(tag>>3), int(tag&0x7)
+		require.Equal(t, protoWireBytes, wireType, "only length-delimited fields are expected")
+
+		length, n := readVarint(t, buf)
+		buf = buf[n:]
+		payload := buf[:length]
+		buf = buf[length:]
+
+		switch fieldNum {
+		case aggPartitionKeyTableField:
+			partitionKeys = append(partitionKeys, string(payload))
+		case aggRecordsField:
+			records = append(records, decodeKPLRecord(t, payload))
+		default:
+			t.Fatalf("unexpected field number %d", fieldNum)
+		}
+	}
+	return partitionKeys, records
+}
+
+func decodeKPLRecord(t *testing.T, buf []byte) decodedKPLRecord {
+	t.Helper()
+	var rec decodedKPLRecord
+	for len(buf) > 0 {
+		tag, n := readVarint(t, buf)
+		buf = buf[n:]
+		fieldNum, wireType := int(tag>>3), int(tag&0x7)
+
+		switch fieldNum {
+		case recordPartitionKeyIndexField:
+			require.Equal(t, protoWireVarint, wireType)
+			v, n := readVarint(t, buf)
+			buf = buf[n:]
+			rec.partitionKeyIndex = v
+		case recordDataField:
+			require.Equal(t, protoWireBytes, wireType)
+			length, n := readVarint(t, buf)
+			buf = buf[n:]
+			rec.data = buf[:length]
+			buf = buf[length:]
+		default:
+			t.Fatalf("unexpected Record field number %d", fieldNum)
+		}
+	}
+	return rec
+}
+
+func readVarint(t *testing.T, buf []byte) (uint64, int) {
+	t.Helper()
+	var v uint64
+	var shift uint
+	for i, b := range buf {
+		v |= uint64(b&0x7f) << shift
+		if b < 0x80 {
+			return v, i + 1
+		}
+		shift += 7
+	}
+	t.Fatal("truncated varint")
+	return 0, 0
+}
+
+func TestKPLAggregatorFinalize(t *testing.T) {
+	agg := newKPLAggregator()
+	agg.Add("", []byte("{\"a\":1}\n"))
+	agg.Add("", []byte("{\"b\":2}\n"))
+
+	out := agg.Finalize()
+
+	partitionKeys, records := decodeKPLAggregate(t, out)
+	assert.Equal(t, []string{"0"}, partitionKeys)
+	require.Len(t, records, 2)
+	assert.Equal(t, "{\"a\":1}\n", string(records[0].data))
+	assert.Equal(t, "{\"b\":2}\n", string(records[1].data))
+	assert.EqualValues(t, 0, records[0].partitionKeyIndex)
+	assert.EqualValues(t, 0, records[1].partitionKeyIndex)
+
+	assert.Equal(t, 0, agg.Len(), "aggregator should be empty after Finalize")
+}
+
+func TestKPLAggregatorSizeMatchesFinalize(t *testing.T) {
+	agg := newKPLAggregator()
+	data := bytes.Repeat([]byte("x"), 250)
+
+	for i := 0; i < 5; i++ {
+		agg.Add("", data)
+	}
+
+	sizeBeforeFinalize := agg.Size()
+	out := agg.Finalize()
+	assert.Equal(t, sizeBeforeFinalize, len(out))
+}
+
+func TestKPLAggregatorWouldExceedKeepsAggregateUnderLimit(t *testing.T) {
+	agg := newKPLAggregator()
+	const limit = 1000
+	data := bytes.Repeat([]byte("y"), 100)
+
+	for !agg.WouldExceed("", data, limit) {
+		agg.Add("", data)
+	}
+
+	assert.LessOrEqual(t, agg.Size(), limit)
+	assert.Greater(t, agg.Len(), 0)
+}
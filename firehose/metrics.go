@@ -0,0 +1,37 @@
+// Copyright 2019 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//	http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package firehose
+
+import "sync/atomic"
+
+// dlqDroppedTotal counts records permanently dropped to the dead-letter
+// sink. It is kept as a plain monotonic counter, in the same shape a
+// Prometheus client library would expose, without pulling in the full
+// client as a dependency. Nothing in this plugin exposes a /metrics
+// endpoint, so callers log the value incrementDLQDropped returns alongside
+// their existing per-drop log line, which is the only way an operator can
+// currently observe it.
+var dlqDroppedTotal uint64
+
+// incrementDLQDropped records one more dropped record and returns the
+// running total, for the caller to log
+func incrementDLQDropped() uint64 {
+	return atomic.AddUint64(&dlqDroppedTotal, 1)
+}
+
+// DLQDroppedTotal returns the number of records dropped to the
+// dead-letter sink so far, for exporting as a Prometheus counter
+func DLQDroppedTotal() uint64 {
+	return atomic.LoadUint64(&dlqDroppedTotal)
+}
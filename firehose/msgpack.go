@@ -0,0 +1,222 @@
+// Copyright 2019 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//	http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package firehose
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+)
+
+// msgpackEncoder encodes a record as MessagePack (https://msgpack.org/),
+// a compact binary alternative to JSON. It is hand-written rather than
+// pulled in from a third-party library so this package has no new
+// dependency for a single, fairly small encoder.
+type msgpackEncoder struct{}
+
+func (msgpackEncoder) Encode(record map[interface{}]interface{}) ([]byte, error) {
+	return appendMsgpackValue(nil, record)
+}
+
+func appendMsgpackValue(buf []byte, v interface{}) ([]byte, error) {
+	switch t := v.(type) {
+	case nil:
+		return append(buf, 0xc0), nil
+	case bool:
+		if t {
+			return append(buf, 0xc3), nil
+		}
+		return append(buf, 0xc2), nil
+	case string:
+		return appendMsgpackString(buf, t), nil
+	case []byte:
+		return appendMsgpackBin(buf, t), nil
+	case int:
+		return appendMsgpackInt(buf, int64(t)), nil
+	case int8:
+		return appendMsgpackInt(buf, int64(t)), nil
+	case int16:
+		return appendMsgpackInt(buf, int64(t)), nil
+	case int32:
+		return appendMsgpackInt(buf, int64(t)), nil
+	case int64:
+		return appendMsgpackInt(buf, t), nil
+	case uint:
+		return appendMsgpackUint(buf, uint64(t)), nil
+	case uint8:
+		return appendMsgpackUint(buf, uint64(t)), nil
+	case uint16:
+		return appendMsgpackUint(buf, uint64(t)), nil
+	case uint32:
+		return appendMsgpackUint(buf, uint64(t)), nil
+	case uint64:
+		return appendMsgpackUint(buf, t), nil
+	case float32:
+		return appendMsgpackFloat64(buf, float64(t)), nil
+	case float64:
+		return appendMsgpackFloat64(buf, t), nil
+	case []interface{}:
+		return appendMsgpackArray(buf, t)
+	case map[interface{}]interface{}:
+		return appendMsgpackMap(buf, t)
+	case map[string]interface{}:
+		generic := make(map[interface{}]interface{}, len(t))
+		for k, v := range t {
+			generic[k] = v
+		}
+		return appendMsgpackMap(buf, generic)
+	default:
+		return nil, fmt.Errorf("msgpack: unsupported value type %T", v)
+	}
+}
+
+func appendMsgpackString(buf []byte, s string) []byte {
+	n := len(s)
+	switch {
+	case n < 32:
+		buf = append(buf, 0xa0|byte(n))
+	case n < 1<<8:
+		buf = append(buf, 0xd9, byte(n))
+	case n < 1<<16:
+		buf = append(buf, 0xda, 0, 0)
+		binary.BigEndian.PutUint16(buf[len(buf)-2:], uint16(n))
+	default:
+		buf = append(buf, 0xdb, 0, 0, 0, 0)
+		binary.BigEndian.PutUint32(buf[len(buf)-4:], uint32(n))
+	}
+	return append(buf, s...)
+}
+
+func appendMsgpackBin(buf []byte, data []byte) []byte {
+	n := len(data)
+	switch {
+	case n < 1<<8:
+		buf = append(buf, 0xc4, byte(n))
+	case n < 1<<16:
+		buf = append(buf, 0xc5, 0, 0)
+		binary.BigEndian.PutUint16(buf[len(buf)-2:], uint16(n))
+	default:
+		buf = append(buf, 0xc6, 0, 0, 0, 0)
+		binary.BigEndian.PutUint32(buf[len(buf)-4:], uint32(n))
+	}
+	return append(buf, data...)
+}
+
+func appendMsgpackInt(buf []byte, v int64) []byte {
+	switch {
+	case v >= 0:
+		return appendMsgpackUint(buf, uint64(v))
+	case v >= -32:
+		return append(buf, byte(v))
+	case v >= math.MinInt8:
+		return append(buf, 0xd0, byte(v))
+	case v >= math.MinInt16:
+		b := make([]byte, 2)
+		binary.BigEndian.PutUint16(b, uint16(v))
+		return append(append(buf, 0xd1), b...)
+	case v >= math.MinInt32:
+		b := make([]byte, 4)
+		binary.BigEndian.PutUint32(b, uint32(v))
+		return append(append(buf, 0xd2), b...)
+	default:
+		b := make([]byte, 8)
+		binary.BigEndian.PutUint64(b, uint64(v))
+		return append(append(buf, 0xd3), b...)
+	}
+}
+
+func appendMsgpackUint(buf []byte, v uint64) []byte {
+	switch {
+	case v < 1<<7:
+		return append(buf, byte(v))
+	case v < 1<<8:
+		return append(buf, 0xcc, byte(v))
+	case v < 1<<16:
+		b := make([]byte, 2)
+		binary.BigEndian.PutUint16(b, uint16(v))
+		return append(append(buf, 0xcd), b...)
+	case v < 1<<32:
+		b := make([]byte, 4)
+		binary.BigEndian.PutUint32(b, uint32(v))
+		return append(append(buf, 0xce), b...)
+	default:
+		b := make([]byte, 8)
+		binary.BigEndian.PutUint64(b, v)
+		return append(append(buf, 0xcf), b...)
+	}
+}
+
+func appendMsgpackFloat64(buf []byte, v float64) []byte {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, math.Float64bits(v))
+	return append(append(buf, 0xcb), b...)
+}
+
+func appendMsgpackArray(buf []byte, items []interface{}) ([]byte, error) {
+	buf = appendMsgpackArrayHeader(buf, len(items))
+	var err error
+	for _, item := range items {
+		buf, err = appendMsgpackValue(buf, item)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return buf, nil
+}
+
+func appendMsgpackArrayHeader(buf []byte, n int) []byte {
+	switch {
+	case n < 16:
+		return append(buf, 0x90|byte(n))
+	case n < 1<<16:
+		b := make([]byte, 2)
+		binary.BigEndian.PutUint16(b, uint16(n))
+		return append(append(buf, 0xdc), b...)
+	default:
+		b := make([]byte, 4)
+		binary.BigEndian.PutUint32(b, uint32(n))
+		return append(append(buf, 0xdd), b...)
+	}
+}
+
+func appendMsgpackMap(buf []byte, m map[interface{}]interface{}) ([]byte, error) {
+	buf = appendMsgpackMapHeader(buf, len(m))
+	var err error
+	for k, v := range m {
+		buf, err = appendMsgpackValue(buf, k)
+		if err != nil {
+			return nil, err
+		}
+		buf, err = appendMsgpackValue(buf, v)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return buf, nil
+}
+
+func appendMsgpackMapHeader(buf []byte, n int) []byte {
+	switch {
+	case n < 16:
+		return append(buf, 0x80|byte(n))
+	case n < 1<<16:
+		b := make([]byte, 2)
+		binary.BigEndian.PutUint16(b, uint16(n))
+		return append(append(buf, 0xde), b...)
+	default:
+		b := make([]byte, 4)
+		binary.BigEndian.PutUint32(b, uint32(n))
+		return append(append(buf, 0xdf), b...)
+	}
+}
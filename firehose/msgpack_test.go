@@ -0,0 +1,85 @@
+// Copyright 2019 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//	http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package firehose
+
+import (
+	"encoding/binary"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// decodeMsgpackString decodes a single msgpack-encoded string value,
+// enough to assert what msgpackEncoder produced without pulling in a
+// third-party msgpack library just for tests
+func decodeMsgpackString(t *testing.T, buf []byte) string {
+	t.Helper()
+	require.NotEmpty(t, buf)
+
+	b0 := buf[0]
+	switch {
+	case b0&0xe0 == 0xa0:
+		n := int(b0 & 0x1f)
+		return string(buf[1 : 1+n])
+	case b0 == 0xd9:
+		n := int(buf[1])
+		return string(buf[2 : 2+n])
+	case b0 == 0xda:
+		n := int(binary.BigEndian.Uint16(buf[1:3]))
+		return string(buf[3 : 3+n])
+	default:
+		t.Fatalf("unexpected msgpack string header 0x%x", b0)
+		return ""
+	}
+}
+
+func TestMsgpackEncoderFixstr(t *testing.T) {
+	data, err := msgpackEncoder{}.Encode(map[interface{}]interface{}{})
+	require.NoError(t, err)
+	assert.Equal(t, []byte{0x80}, data, "empty map should encode as fixmap of size 0")
+
+	data, err = appendMsgpackValue(nil, "hi")
+	require.NoError(t, err)
+	assert.Equal(t, "hi", decodeMsgpackString(t, data))
+}
+
+func TestMsgpackEncoderStr8ForLongStrings(t *testing.T) {
+	long := make([]byte, 40)
+	for i := range long {
+		long[i] = 'x'
+	}
+
+	data, err := appendMsgpackValue(nil, string(long))
+	require.NoError(t, err)
+	require.Equal(t, byte(0xd9), data[0])
+	assert.Equal(t, string(long), decodeMsgpackString(t, data))
+}
+
+func TestMsgpackEncoderPositiveFixint(t *testing.T) {
+	data, err := appendMsgpackValue(nil, 42)
+	require.NoError(t, err)
+	assert.Equal(t, []byte{0x2a}, data)
+}
+
+func TestMsgpackEncoderNegativeInt(t *testing.T) {
+	data, err := appendMsgpackValue(nil, -1)
+	require.NoError(t, err)
+	assert.Equal(t, []byte{0xff}, data, "-1 should encode as a negative fixint")
+}
+
+func TestMsgpackEncoderUnsupportedType(t *testing.T) {
+	_, err := appendMsgpackValue(nil, struct{}{})
+	assert.Error(t, err)
+}
@@ -0,0 +1,164 @@
+// Copyright 2019 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//	http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package firehose
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// spooledRecord is a single record that has been persisted to the spool
+// directory, along with the path it was written to
+type spooledRecord struct {
+	path string
+	data []byte
+}
+
+// diskSpool persists records to disk before they enter the in-memory batch,
+// so that data is not lost if Firehose is throttled or the process is
+// killed before a batch is successfully sent
+type diskSpool struct {
+	dir      string
+	maxBytes int64
+	maxAge   time.Duration
+	pluginID int
+}
+
+// newDiskSpool creates the spool directory if necessary and returns a
+// diskSpool that writes into it. An empty dir disables spooling entirely
+// and returns a nil diskSpool.
+func newDiskSpool(dir string, maxBytes int64, maxAge time.Duration, pluginID int) (*diskSpool, error) {
+	if dir == "" {
+		return nil, nil
+	}
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create buffer_dir %s: %v", dir, err)
+	}
+
+	return &diskSpool{
+		dir:      dir,
+		maxBytes: maxBytes,
+		maxAge:   maxAge,
+		pluginID: pluginID,
+	}, nil
+}
+
+// Write persists data to a new file in the spool directory and returns the
+// path of the file, which the caller later passes to Remove once the record
+// has been durably delivered to Firehose
+func (s *diskSpool) Write(data []byte) (string, error) {
+	if s.maxBytes > 0 {
+		size, err := s.Size()
+		if err != nil {
+			logrus.Errorf("[firehose %d] Failed to stat buffer_dir %s: %v\n", s.pluginID, s.dir, err)
+		} else if size+int64(len(data)) > s.maxBytes {
+			return "", fmt.Errorf("buffer_dir %s is at its buffer_max_bytes limit of %d bytes", s.dir, s.maxBytes)
+		}
+	}
+
+	f, err := ioutil.TempFile(s.dir, "record-*.spool")
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	if _, err := f.Write(data); err != nil {
+		os.Remove(f.Name())
+		return "", err
+	}
+
+	return f.Name(), nil
+}
+
+// Remove deletes a previously spooled file. It is not an error to remove a
+// file that no longer exists.
+func (s *diskSpool) Remove(path string) error {
+	if path == "" {
+		return nil
+	}
+
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	return nil
+}
+
+// Pending returns the records left over in the spool directory from a
+// previous process, oldest first, so they can be replayed into the
+// in-memory batch on startup. Entries older than maxAge are dropped instead
+// of being replayed.
+func (s *diskSpool) Pending() ([]spooledRecord, error) {
+	entries, err := ioutil.ReadDir(s.dir)
+	if err != nil {
+		return nil, err
+	}
+
+	// ioutil.ReadDir sorts by filename, but spool files are named
+	// record-<random>.spool, so sort by ModTime to actually replay oldest
+	// first. SliceStable keeps ReadDir's filename order as the tiebreak for
+	// entries with indistinguishable timestamps.
+	sort.SliceStable(entries, func(i, j int) bool {
+		return entries[i].ModTime().Before(entries[j].ModTime())
+	})
+
+	pending := make([]spooledRecord, 0, len(entries))
+	now := time.Now()
+	for _, entry := range entries {
+		if entry.IsDir() {
+			continue
+		}
+
+		path := filepath.Join(s.dir, entry.Name())
+		if s.maxAge > 0 && now.Sub(entry.ModTime()) > s.maxAge {
+			logrus.Warnf("[firehose %d] Dropping expired spooled record %s\n", s.pluginID, path)
+			os.Remove(path)
+			continue
+		}
+
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			logrus.Errorf("[firehose %d] Failed to read spooled record %s: %v\n", s.pluginID, path, err)
+			continue
+		}
+
+		pending = append(pending, spooledRecord{path: path, data: data})
+	}
+
+	return pending, nil
+}
+
+// Size returns the total number of bytes currently spooled to disk
+func (s *diskSpool) Size() (int64, error) {
+	entries, err := ioutil.ReadDir(s.dir)
+	if err != nil {
+		return 0, err
+	}
+
+	var size int64
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			size += entry.Size()
+		}
+	}
+
+	return size, nil
+}
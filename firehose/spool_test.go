@@ -0,0 +1,126 @@
+// Copyright 2019 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//	http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package firehose
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDiskSpoolWriteAndPending(t *testing.T) {
+	dir, err := ioutil.TempDir("", "spool-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	spool, err := newDiskSpool(dir, 0, 0, 0)
+	require.NoError(t, err)
+
+	_, err = spool.Write([]byte("a"))
+	require.NoError(t, err)
+	_, err = spool.Write([]byte("b"))
+	require.NoError(t, err)
+
+	pending, err := spool.Pending()
+	require.NoError(t, err)
+	require.Len(t, pending, 2)
+}
+
+func TestDiskSpoolPendingReturnsOldestFirst(t *testing.T) {
+	dir, err := ioutil.TempDir("", "spool-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	spool, err := newDiskSpool(dir, 0, 0, 0)
+	require.NoError(t, err)
+
+	// Name the files so that lexicographic order is the reverse of
+	// chronological order, to make sure Pending sorts by ModTime rather
+	// than relying on ioutil.ReadDir's filename ordering
+	newest := filepath.Join(dir, "a-newest.spool")
+	oldest := filepath.Join(dir, "z-oldest.spool")
+	require.NoError(t, ioutil.WriteFile(oldest, []byte("oldest"), 0644))
+	require.NoError(t, os.Chtimes(oldest, time.Now().Add(-time.Hour), time.Now().Add(-time.Hour)))
+	require.NoError(t, ioutil.WriteFile(newest, []byte("newest"), 0644))
+
+	pending, err := spool.Pending()
+	require.NoError(t, err)
+	require.Len(t, pending, 2)
+	assert.Equal(t, "oldest", string(pending[0].data))
+	assert.Equal(t, "newest", string(pending[1].data))
+}
+
+func TestDiskSpoolPendingDropsExpiredRecords(t *testing.T) {
+	dir, err := ioutil.TempDir("", "spool-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	spool, err := newDiskSpool(dir, 0, time.Minute, 0)
+	require.NoError(t, err)
+
+	expired := filepath.Join(dir, "expired.spool")
+	require.NoError(t, ioutil.WriteFile(expired, []byte("old"), 0644))
+	require.NoError(t, os.Chtimes(expired, time.Now().Add(-time.Hour), time.Now().Add(-time.Hour)))
+
+	fresh, err := spool.Write([]byte("new"))
+	require.NoError(t, err)
+
+	pending, err := spool.Pending()
+	require.NoError(t, err)
+	require.Len(t, pending, 1)
+	assert.Equal(t, fresh, pending[0].path)
+	assert.NoFileExists(t, expired)
+}
+
+func TestDiskSpoolWriteRejectsWhenOverMaxBytes(t *testing.T) {
+	dir, err := ioutil.TempDir("", "spool-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	spool, err := newDiskSpool(dir, 4, 0, 0)
+	require.NoError(t, err)
+
+	_, err = spool.Write([]byte("1234"))
+	require.NoError(t, err)
+
+	_, err = spool.Write([]byte("5"))
+	assert.Error(t, err, "writing past buffer_max_bytes should fail")
+}
+
+func TestDiskSpoolRemove(t *testing.T) {
+	dir, err := ioutil.TempDir("", "spool-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	spool, err := newDiskSpool(dir, 0, 0, 0)
+	require.NoError(t, err)
+
+	path, err := spool.Write([]byte("a"))
+	require.NoError(t, err)
+
+	require.NoError(t, spool.Remove(path))
+	assert.NoFileExists(t, path)
+	assert.NoError(t, spool.Remove(path), "removing an already-removed file is not an error")
+}
+
+func TestNewDiskSpoolDisabledWithoutDir(t *testing.T) {
+	spool, err := newDiskSpool("", 0, 0, 0)
+	require.NoError(t, err)
+	assert.Nil(t, spool)
+}
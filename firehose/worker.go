@@ -0,0 +1,258 @@
+// Copyright 2019 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//	http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package firehose
+
+import (
+	"math/rand"
+	"os"
+	"time"
+
+	"github.com/aws/amazon-kinesis-firehose-for-fluent-bit/plugins"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/firehose"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// maxWorkerRetries bounds the number of backoff attempts a worker makes
+	// for a single batch before requeuing it for another worker to try
+	maxWorkerRetries = 5
+	// maxRetryAttempts bounds how many times a record can be requeued after
+	// a PutRecordBatch failure before it is dropped
+	maxRetryAttempts = 20
+	backoffBase      = 500 * time.Millisecond
+	backoffMax       = 30 * time.Second
+)
+
+// batchJob is a batch of records in flight to Firehose, along with the
+// spool files backing them and a per-record count of delivery attempts
+type batchJob struct {
+	records    []*firehose.Record
+	spoolPaths [][]string
+	attempts   []int
+}
+
+// startWorkers launches the worker pool that drains batchCh. It is a no-op
+// when concurrency is 1, since sendCurrentBatch already sends synchronously
+// in that case and spinning up a goroutine would be wasted overhead.
+func (output *OutputPlugin) startWorkers() {
+	if output.concurrency <= 1 {
+		return
+	}
+
+	output.batchCh = make(chan *batchJob, output.concurrency)
+	for i := 0; i < output.concurrency; i++ {
+		go output.worker(i)
+	}
+}
+
+func (output *OutputPlugin) worker(id int) {
+	for job := range output.batchCh {
+		output.processJob(id, job)
+	}
+}
+
+// processJob sends a batch on behalf of a worker, retrying with exponential
+// backoff and jitter on throttling and transient errors. If the batch still
+// fails after maxWorkerRetries, its records are requeued into the retry
+// queue instead of being merged back into output.records, so they don't
+// block data that is still arriving on the main Fluent Bit thread.
+func (output *OutputPlugin) processJob(workerID int, job *batchJob) {
+	timer := output.workerTimers[workerID]
+
+	var response *firehose.PutRecordBatchOutput
+	var err error
+	for attempt := 0; ; attempt++ {
+		timer.Check()
+		response, err = output.client.PutRecordBatch(&firehose.PutRecordBatchInput{
+			DeliveryStreamName: aws.String(output.deliveryStream),
+			Records:            job.records,
+		})
+		if err == nil {
+			break
+		}
+
+		logrus.Errorf("[firehose %d] worker %d: PutRecordBatch failed with %v", output.PluginID, workerID, err)
+		if !isRetryableError(err) || attempt >= maxWorkerRetries {
+			timer.Start()
+			output.requeueAll(job)
+			return
+		}
+		time.Sleep(backoffWithJitter(attempt))
+	}
+
+	timer.Reset()
+	output.givenUpMu.Lock()
+	delete(output.givenUpWorkers, workerID)
+	output.givenUpMu.Unlock()
+	logrus.Debugf("[firehose %d] worker %d: sent %d events to Firehose\n", output.PluginID, workerID, len(job.records))
+	output.handleJobResponse(workerID, job, response)
+}
+
+// handleJobResponse splits a PutRecordBatch response into the records that
+// succeeded, whose spool files can be removed, and the records that failed,
+// which are requeued for another attempt
+func (output *OutputPlugin) handleJobResponse(workerID int, job *batchJob, response *firehose.PutRecordBatchOutput) {
+	if aws.Int64Value(response.FailedPutCount) == 0 {
+		for _, paths := range job.spoolPaths {
+			output.removeSpoolPaths(paths)
+		}
+		return
+	}
+
+	logrus.Warnf("[firehose %d] worker %d: %d records failed to be delivered. Will retry.\n", output.PluginID, workerID, aws.Int64Value(response.FailedPutCount))
+
+	failed := &batchJob{}
+	for i, record := range response.RequestResponses {
+		if record.ErrorMessage == nil {
+			output.removeSpoolPaths(job.spoolPaths[i])
+			continue
+		}
+
+		logrus.Debugf("[firehose %d] worker %d: record failed to send with error: %s\n", output.PluginID, workerID, aws.StringValue(record.ErrorMessage))
+		if aws.StringValue(record.ErrorCode) == firehose.ErrCodeServiceUnavailableException {
+			logrus.Warnf("[firehose %d] worker %d: throughput limits for the delivery stream may have been exceeded.\n", output.PluginID, workerID)
+		}
+
+		failed.records = append(failed.records, job.records[i])
+		failed.spoolPaths = append(failed.spoolPaths, job.spoolPaths[i])
+		failed.attempts = append(failed.attempts, job.attempts[i]+1)
+	}
+
+	output.requeueRecords(failed)
+}
+
+// requeueAll treats every record in the job as failed, used when
+// PutRecordBatch itself errored out rather than returning per-record results
+func (output *OutputPlugin) requeueAll(job *batchJob) {
+	next := &batchJob{
+		records:    job.records,
+		spoolPaths: job.spoolPaths,
+		attempts:   make([]int, len(job.attempts)),
+	}
+	for i, a := range job.attempts {
+		next.attempts[i] = a + 1
+	}
+	output.requeueRecords(next)
+}
+
+// requeueRecords appends to the dedicated retry queue, dropping any record
+// that has already exceeded its retry limit. If a dead-letter sink is
+// configured, dropped records go there instead of being discarded.
+func (output *OutputPlugin) requeueRecords(job *batchJob) {
+	output.retryMu.Lock()
+	defer output.retryMu.Unlock()
+
+	limit := maxRetryAttempts
+	if output.dlqSink != nil {
+		limit = output.dlqMaxAttempts
+	}
+
+	for i, record := range job.records {
+		if job.attempts[i] > limit {
+			if output.dlqSink != nil {
+				output.dlqSink.Write(record.Data)
+				total := incrementDLQDropped()
+				logrus.Errorf("[firehose %d] Dropping record to dead-letter sink after %d failed delivery attempts (%d dropped total)\n", output.PluginID, job.attempts[i], total)
+			} else {
+				logrus.Errorf("[firehose %d] Dropping record after %d failed delivery attempts\n", output.PluginID, job.attempts[i])
+			}
+			output.removeSpoolPaths(job.spoolPaths[i])
+			continue
+		}
+		output.retryRecords = append(output.retryRecords, record)
+		output.retrySpoolPaths = append(output.retrySpoolPaths, job.spoolPaths[i])
+		output.retryAttempts = append(output.retryAttempts, job.attempts[i])
+	}
+}
+
+// flushRetryQueue hands the current retry queue to a worker as its own
+// batch, separate from newly arriving data. If every worker is busy and the
+// pool's queue of pending batches is full, the records are put back in the
+// retry queue for the next attempt.
+func (output *OutputPlugin) flushRetryQueue() {
+	output.retryMu.Lock()
+	if len(output.retryRecords) == 0 {
+		output.retryMu.Unlock()
+		return
+	}
+	job := &batchJob{
+		records:    output.retryRecords,
+		spoolPaths: output.retrySpoolPaths,
+		attempts:   output.retryAttempts,
+	}
+	output.retryRecords = nil
+	output.retrySpoolPaths = nil
+	output.retryAttempts = nil
+	output.retryMu.Unlock()
+
+	select {
+	case output.batchCh <- job:
+	default:
+		output.requeueRecords(job)
+	}
+}
+
+// isRetryableError reports whether a PutRecordBatch error is the kind of
+// transient throttling or server-side failure that's worth a backoff retry,
+// as opposed to a permanent client error
+func isRetryableError(err error) bool {
+	aerr, ok := err.(awserr.Error)
+	if !ok {
+		return true
+	}
+
+	switch aerr.Code() {
+	case firehose.ErrCodeServiceUnavailableException, firehose.ErrCodeLimitExceededException:
+		return true
+	}
+
+	if reqErr, ok := err.(awserr.RequestFailure); ok {
+		return reqErr.StatusCode() >= 500
+	}
+
+	return false
+}
+
+// backoffWithJitter returns an exponentially increasing delay, capped at
+// backoffMax, with up to 50% jitter to avoid every worker retrying in lockstep
+func backoffWithJitter(attempt int) time.Duration {
+	d := backoffBase * time.Duration(1<<uint(attempt))
+	if d <= 0 || d > backoffMax {
+		d = backoffMax
+	}
+	jitter := time.Duration(rand.Int63n(int64(d)/2 + 1))
+	return d/2 + jitter
+}
+
+// newWorkerTimeout creates a per-worker timeout. Unlike the single global
+// timer used for synchronous sends, the plugin only exits once every worker
+// has independently timed out, so one stuck shard doesn't take down a
+// pipeline that is otherwise making progress.
+func newWorkerTimeout(output *OutputPlugin, workerID int) (*plugins.Timeout, error) {
+	return plugins.NewTimeout(func(d time.Duration) {
+		logrus.Errorf("[firehose %d] worker %d: timeout threshold reached: Failed to send logs for %s\n", output.PluginID, workerID, d.String())
+
+		output.givenUpMu.Lock()
+		output.givenUpWorkers[workerID] = true
+		allGivenUp := len(output.givenUpWorkers) == output.concurrency
+		output.givenUpMu.Unlock()
+
+		if allGivenUp {
+			logrus.Errorf("[firehose %d] All %d workers have stopped making progress. Quitting Fluent Bit", output.PluginID, output.concurrency)
+			os.Exit(1)
+		}
+	})
+}
@@ -0,0 +1,155 @@
+// Copyright 2019 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//	http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package firehose
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/firehose"
+	fluentbit "github.com/fluent/fluent-bit-go/output"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSendBatchConcurrentDispatchesAndRemovesSpoolFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "worker-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	spool, err := newDiskSpool(dir, 0, 0, 0)
+	require.NoError(t, err)
+
+	path1, err := spool.Write([]byte("one"))
+	require.NoError(t, err)
+	path2, err := spool.Write([]byte("two"))
+	require.NoError(t, err)
+
+	fake := &fakeBatcher{}
+	output := newTestOutputPlugin(t, fake, 2)
+	output.spool = spool
+	output.records = append(output.records,
+		&firehose.Record{Data: []byte("one")},
+		&firehose.Record{Data: []byte("two")},
+	)
+	output.spoolPaths = append(output.spoolPaths, []string{path1}, []string{path2})
+	output.recordAttempts = append(output.recordAttempts, 0, 0)
+
+	retCode, err := output.sendCurrentBatch()
+	require.NoError(t, err)
+	assert.Equal(t, fluentbit.FLB_OK, retCode)
+
+	assert.Empty(t, output.records, "records should be cleared on handoff to the worker pool")
+	assert.Empty(t, output.spoolPaths)
+	assert.Empty(t, output.recordAttempts, "recordAttempts should be cleared in lockstep with records, not left stale")
+
+	require.Eventually(t, func() bool {
+		return fake.callCount() == 1
+	}, time.Second, 5*time.Millisecond, "worker pool should have dispatched the batch")
+
+	require.Eventually(t, func() bool {
+		_, err1 := os.Stat(path1)
+		_, err2 := os.Stat(path2)
+		return os.IsNotExist(err1) && os.IsNotExist(err2)
+	}, time.Second, 5*time.Millisecond, "successful delivery should remove the spooled files")
+}
+
+// failingBatcher reports every record in the batch as failed, so tests can
+// exercise the worker pool's retry path
+type failingBatcher struct{}
+
+func (failingBatcher) PutRecordBatch(input *firehose.PutRecordBatchInput) (*firehose.PutRecordBatchOutput, error) {
+	responses := make([]*firehose.PutRecordBatchResponseEntry, len(input.Records))
+	for i := range responses {
+		responses[i] = &firehose.PutRecordBatchResponseEntry{ErrorMessage: aws.String("boom")}
+	}
+	return &firehose.PutRecordBatchOutput{
+		FailedPutCount:   aws.Int64(int64(len(input.Records))),
+		RequestResponses: responses,
+	}, nil
+}
+
+func TestSendBatchConcurrentCarriesRealRecordAttemptsIntoTheJob(t *testing.T) {
+	output := newTestOutputPlugin(t, failingBatcher{}, 2)
+	output.records = append(output.records, &firehose.Record{Data: []byte("x")})
+	output.spoolPaths = append(output.spoolPaths, []string{""})
+	output.recordAttempts = append(output.recordAttempts, 3)
+
+	_, err := output.sendCurrentBatch()
+	require.NoError(t, err)
+
+	require.Eventually(t, func() bool {
+		output.retryMu.Lock()
+		defer output.retryMu.Unlock()
+		return len(output.retryAttempts) == 1
+	}, time.Second, 5*time.Millisecond, "the failed record should land back in the retry queue")
+
+	output.retryMu.Lock()
+	defer output.retryMu.Unlock()
+	assert.Equal(t, 4, output.retryAttempts[0], "the job handed to the worker pool must start from the record's real attempt count, not 0")
+}
+
+func TestRequeueRecordsDropsToDeadLetterSinkAfterMaxAttempts(t *testing.T) {
+	fakeS3 := &fakeS3Putter{}
+	output := newTestOutputPlugin(t, &fakeBatcher{}, 2)
+	output.dlqSink = &s3DeadLetterSink{client: fakeS3, bucket: "my-bucket", deliveryStream: "my-stream"}
+	output.dlqMaxAttempts = 2
+
+	job := &batchJob{
+		records:    []*firehose.Record{{Data: []byte("x")}},
+		spoolPaths: [][]string{{""}},
+		attempts:   []int{3},
+	}
+
+	output.requeueRecords(job)
+	output.dlqSink.Flush()
+
+	assert.Empty(t, output.retryRecords, "record past dlqMaxAttempts should not be requeued")
+	assert.Len(t, fakeS3.puts, 1, "record past dlqMaxAttempts should be sent to the dead-letter sink")
+}
+
+func TestRequeueRecordsKeepsRecordUnderMaxAttempts(t *testing.T) {
+	output := newTestOutputPlugin(t, &fakeBatcher{}, 2)
+
+	job := &batchJob{
+		records:    []*firehose.Record{{Data: []byte("x")}},
+		spoolPaths: [][]string{{""}},
+		attempts:   []int{1},
+	}
+
+	output.requeueRecords(job)
+
+	require.Len(t, output.retryRecords, 1)
+	assert.Equal(t, 1, output.retryAttempts[0])
+}
+
+func TestIsRetryableError(t *testing.T) {
+	assert.True(t, isRetryableError(errors.New("boom")), "non-AWS errors should default to retryable")
+	assert.True(t, isRetryableError(awserr.New(firehose.ErrCodeServiceUnavailableException, "unavailable", nil)))
+	assert.True(t, isRetryableError(awserr.New(firehose.ErrCodeLimitExceededException, "limit exceeded", nil)))
+	assert.False(t, isRetryableError(awserr.New(firehose.ErrCodeInvalidArgumentException, "invalid", nil)))
+}
+
+func TestBackoffWithJitterIsBounded(t *testing.T) {
+	for attempt := 0; attempt < 10; attempt++ {
+		d := backoffWithJitter(attempt)
+		assert.Greater(t, d, time.Duration(0))
+		assert.LessOrEqual(t, d, backoffMax)
+	}
+}
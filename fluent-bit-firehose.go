@@ -15,18 +15,41 @@ package main
 
 import (
 	"C"
-	"fmt"
+	"strconv"
 	"unsafe"
 
-	"github.com/awslabs/amazon-kinesis-firehose-for-fluent-bit/firehose"
+	"github.com/aws/amazon-kinesis-firehose-for-fluent-bit/firehose"
+	"github.com/aws/amazon-kinesis-firehose-for-fluent-bit/plugins"
 	"github.com/fluent/fluent-bit-go/output"
+
+	"github.com/sirupsen/logrus"
+)
+import (
+	"fmt"
+	"time"
 )
-import "github.com/Sirupsen/logrus"
 
 var (
-	out *firehose.FirehoseOutput
+	pluginInstances []*firehose.OutputPlugin
 )
 
+func addPluginInstance(ctx unsafe.Pointer) error {
+	pluginID := len(pluginInstances)
+	output.FLBPluginSetContext(ctx, pluginID)
+	instance, err := newFirehoseOutput(ctx, pluginID)
+	if err != nil {
+		return err
+	}
+
+	pluginInstances = append(pluginInstances, instance)
+	return nil
+}
+
+func getPluginInstance(ctx unsafe.Pointer) *firehose.OutputPlugin {
+	pluginID := output.FLBPluginGetContext(ctx).(int)
+	return pluginInstances[pluginID]
+}
+
 // The "export" comments have syntactic meaning
 // This is how the compiler knows a function should be callable from the C code
 
@@ -35,68 +58,156 @@ func FLBPluginRegister(ctx unsafe.Pointer) int {
 	return output.FLBPluginRegister(ctx, "firehose", "Amazon Kinesis Data Firehose Fluent Bit Plugin.")
 }
 
-//export FLBPluginInit
-func FLBPluginInit(ctx unsafe.Pointer) int {
-	plugins.SetupLogger()
-
-	deliveryStream := output.FLBPluginConfigKey(ctx, "delivery-stream")
-	logrus.Infof("[firehose] plugin parameter = '%s'\n", deliveryStream)
+func newFirehoseOutput(ctx unsafe.Pointer, pluginID int) (*firehose.OutputPlugin, error) {
+	deliveryStream := output.FLBPluginConfigKey(ctx, "delivery_stream")
+	logrus.Infof("[firehose %d] plugin parameter delivery_stream = '%s'", pluginID, deliveryStream)
 	region := output.FLBPluginConfigKey(ctx, "region")
-	logrus.Infof("[firehose] plugin parameter = '%s'\n", region)
+	logrus.Infof("[firehose %d] plugin parameter region = '%s'", pluginID, region)
 	dataKeys := output.FLBPluginConfigKey(ctx, "data_keys")
-	logrus.Infof("[firehose] plugin parameter = '%s'\n", dataKeys)
+	logrus.Infof("[firehose %d] plugin parameter data_keys = '%s'", pluginID, dataKeys)
 	roleARN := output.FLBPluginConfigKey(ctx, "role_arn")
-	logrus.Infof("[firehose] plugin parameter = '%s'\n", roleARN)
+	logrus.Infof("[firehose %d] plugin parameter role_arn = '%s'", pluginID, roleARN)
+	firehoseEndpoint := output.FLBPluginConfigKey(ctx, "endpoint")
+	logrus.Infof("[firehose %d] plugin parameter endpoint = '%s'", pluginID, firehoseEndpoint)
+	stsEndpoint := output.FLBPluginConfigKey(ctx, "sts_endpoint")
+	logrus.Infof("[firehose %d] plugin parameter sts_endpoint = '%s'", pluginID, stsEndpoint)
+	timeKey := output.FLBPluginConfigKey(ctx, "time_key")
+	logrus.Infof("[firehose %d] plugin parameter time_key = '%s'", pluginID, timeKey)
+	timeKeyFmt := output.FLBPluginConfigKey(ctx, "time_key_format")
+	logrus.Infof("[firehose %d] plugin parameter time_key_format = '%s'", pluginID, timeKeyFmt)
+	logKey := output.FLBPluginConfigKey(ctx, "log_key")
+	logrus.Infof("[firehose %d] plugin parameter log_key = '%s'", pluginID, logKey)
+	replaceDots := output.FLBPluginConfigKey(ctx, "replace_dots")
+	logrus.Infof("[firehose %d] plugin parameter replace_dots = '%s'", pluginID, replaceDots)
+
+	bufferDir := output.FLBPluginConfigKey(ctx, "buffer_dir")
+	logrus.Infof("[firehose %d] plugin parameter buffer_dir = '%s'", pluginID, bufferDir)
+	bufferMaxBytes := parseInt64Param(output.FLBPluginConfigKey(ctx, "buffer_max_bytes"), 0, pluginID, "buffer_max_bytes")
+	bufferMaxAge := parseDurationParam(output.FLBPluginConfigKey(ctx, "buffer_max_age"), 0, pluginID, "buffer_max_age")
+
+	aggregation := output.FLBPluginConfigKey(ctx, "aggregation")
+	logrus.Infof("[firehose %d] plugin parameter aggregation = '%s'", pluginID, aggregation)
+	format := output.FLBPluginConfigKey(ctx, "format")
+	logrus.Infof("[firehose %d] plugin parameter format = '%s'", pluginID, format)
+	compression := output.FLBPluginConfigKey(ctx, "compression")
+	logrus.Infof("[firehose %d] plugin parameter compression = '%s'", pluginID, compression)
+
+	concurrency := int(parseInt64Param(output.FLBPluginConfigKey(ctx, "concurrency"), 1, pluginID, "concurrency"))
+
+	dlqS3Bucket := output.FLBPluginConfigKey(ctx, "dlq_s3_bucket")
+	logrus.Infof("[firehose %d] plugin parameter dlq_s3_bucket = '%s'", pluginID, dlqS3Bucket)
+	dlqS3Prefix := output.FLBPluginConfigKey(ctx, "dlq_s3_prefix")
+	logrus.Infof("[firehose %d] plugin parameter dlq_s3_prefix = '%s'", pluginID, dlqS3Prefix)
+	dlqMaxAttempts := int(parseInt64Param(output.FLBPluginConfigKey(ctx, "dlq_max_attempts"), 0, pluginID, "dlq_max_attempts"))
 
 	if deliveryStream == "" || region == "" {
-		return output.FLB_ERROR
+		return nil, fmt.Errorf("[firehose %d] delivery_stream and region are required configuration parameters", pluginID)
+	}
+
+	return firehose.NewOutputPlugin(region, deliveryStream, dataKeys, roleARN, firehoseEndpoint, stsEndpoint, timeKey,
+		timeKeyFmt, logKey, replaceDots, bufferDir, aggregation, format, compression, bufferMaxBytes, bufferMaxAge,
+		pluginID, concurrency, dlqS3Bucket, dlqS3Prefix, dlqMaxAttempts)
+}
+
+// parseInt64Param parses a plugin config value as an int64, logging and
+// falling back to defaultVal if the parameter was left empty or isn't a
+// valid integer
+func parseInt64Param(param string, defaultVal int64, pluginID int, name string) int64 {
+	if param == "" {
+		return defaultVal
 	}
 
-	var err error
-	out, err = firehose.NewFirehoseOutput(region, deliveryStream, dataKeys, roleARN)
+	val, err := strconv.ParseInt(param, 10, 64)
 	if err != nil {
-		logrus.Debugf("firehose: Failed to initialize plugin: %v\n", err)
+		logrus.Errorf("[firehose %d] Invalid value '%s' for %s, using default %d\n", pluginID, param, name, defaultVal)
+		return defaultVal
+	}
+	return val
+}
+
+// parseDurationParam parses a plugin config value (e.g. "30s", "5m") as a
+// time.Duration, logging and falling back to defaultVal if the parameter
+// was left empty or isn't a valid duration
+func parseDurationParam(param string, defaultVal time.Duration, pluginID int, name string) time.Duration {
+	if param == "" {
+		return defaultVal
+	}
+
+	val, err := time.ParseDuration(param)
+	if err != nil {
+		logrus.Errorf("[firehose %d] Invalid value '%s' for %s, using default %s\n", pluginID, param, name, defaultVal)
+		return defaultVal
+	}
+	return val
+}
+
+//export FLBPluginInit
+func FLBPluginInit(ctx unsafe.Pointer) int {
+	plugins.SetupLogger()
+
+	err := addPluginInstance(ctx)
+	if err != nil {
+		logrus.Errorf("[firehose] Failed to initialize plugin: %v", err)
 		return output.FLB_ERROR
 	}
 	return output.FLB_OK
 }
 
-//export FLBPluginFlush
-func FLBPluginFlush(data unsafe.Pointer, length C.int, tag *C.char) int {
+//export FLBPluginFlushCtx
+func FLBPluginFlushCtx(ctx, data unsafe.Pointer, length C.int, tag *C.char) int {
 	var count int
 	var ret int
+	var ts interface{}
+	var timestamp time.Time
 	var record map[interface{}]interface{}
 
 	// Create Fluent Bit decoder
 	dec := output.NewDecoder(data, int(length))
 
+	firehoseOutput := getPluginInstance(ctx)
 	fluentTag := C.GoString(tag)
-	logrus.Debugf("firehose: Found logs with tag: %s\n", fluentTag)
+	logrus.Debugf("[firehose %d] Found logs with tag: %s", firehoseOutput.PluginID, fluentTag)
 
 	for {
 		// Extract Record
-		ret, _, record = output.GetRecord(dec)
+		ret, ts, record = output.GetRecord(dec)
 		if ret != 0 {
 			break
 		}
 
-		err := out.AddRecord(record)
-		if err != nil {
-			return output.FLB_ERROR
+		switch tts := ts.(type) {
+		case output.FLBTime:
+			timestamp = tts.Time
+		case uint64:
+			// when ts is of type uint64 it appears to
+			// be the amount of seconds since unix epoch.
+			timestamp = time.Unix(int64(tts), 0)
+		default:
+			timestamp = time.Now()
+		}
+
+		retCode := firehoseOutput.AddRecord(record, &timestamp)
+		if retCode != output.FLB_OK {
+			return retCode
 		}
 		count++
 	}
-	err := out.Flush()
-	if err != nil {
-		return output.FLB_ERROR
+	retCode := firehoseOutput.Flush()
+	if retCode != output.FLB_OK {
+		return retCode
 	}
-	fmt.Printf("Processed %d events with tag %s\n", count, fluentTag)
+	logrus.Debugf("[firehose %d] Processed %d events with tag %s", firehoseOutput.PluginID, count, fluentTag)
 
 	return output.FLB_OK
 }
 
 //export FLBPluginExit
 func FLBPluginExit() int {
+	// Before final exit, call Flush() for all the instances of the Output Plugin
+	for i := range pluginInstances {
+		pluginInstances[i].Flush()
+	}
+
 	return output.FLB_OK
 }
 